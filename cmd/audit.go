@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+	"golang.org/x/term"
+)
+
+var (
+	auditRedact bool
+	auditDelete bool
+)
+
+func init() {
+	auditSecretsCmd.Flags().BoolVar(&auditRedact, "redact", false, "mask the secrets found without asking")
+	auditSecretsCmd.Flags().BoolVar(&auditDelete, "delete", false, "delete the entries with secrets without asking")
+	auditCmd.AddCommand(auditSecretsCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "look for problems in the stored history",
+}
+
+var auditSecretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "find stored commands that contain secrets",
+	Long: `audit secrets applies the redaction rules to every stored command and
+annotation, and lists the entries they would mask. It then offers to mask the
+secrets in place or delete those entries. Without a terminal to ask on, pass
+--redact or --delete. The database is compacted afterwards, so the secrets do
+not linger in its free space, but backups and synced machines keep them.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if auditRedact && auditDelete {
+			return fmt.Errorf("pass only one of --redact or --delete")
+		}
+		rules := redactor()
+		if rules == nil {
+			return fmt.Errorf("redaction is disabled in the config")
+		}
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		entries, err := store.All()
+		if err != nil {
+			return err
+		}
+		found := []storage.History{}
+		for _, history := range entries {
+			redacted := history
+			matched := storage.Redact(&redacted, rules)
+			if len(matched) == 0 {
+				continue
+			}
+			fmt.Printf("%s (%s)\n", inZone(history), strings.Join(matched, ", "))
+			found = append(found, redacted)
+		}
+		if len(found) == 0 {
+			fmt.Println("no secrets found")
+			return nil
+		}
+
+		action := "keep"
+		switch {
+		case auditRedact:
+			action = "redact"
+		case auditDelete:
+			action = "delete"
+		case term.IsTerminal(int(os.Stdin.Fd())):
+			action, err = askAuditAction(len(found))
+			if err != nil {
+				return err
+			}
+		}
+		for _, history := range found {
+			switch action {
+			case "redact":
+				err = store.Update(&history)
+			case "delete":
+				err = store.Delete(history.DirectoryName, history.Key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if action == "keep" {
+			fmt.Printf("found secrets in %d entries, run with --redact or --delete to remove them\n", len(found))
+			return nil
+		}
+		// The old values stay in the free pages of the file until it is
+		// compacted.
+		if _, _, err := store.Compact(); err != nil {
+			return fmt.Errorf("removed the secrets from %s but could not compact it: %w", HistorianDatabase, err)
+		}
+		if action == "redact" {
+			fmt.Printf("redacted %d entries\n", len(found))
+		} else {
+			fmt.Printf("deleted %d entries\n", len(found))
+		}
+		fmt.Printf("backups in %s and machines synced with this one still hold the secrets\n", filepath.Join(filepath.Dir(HistorianDatabase), "backups"))
+		return nil
+	},
+}
+
+// askAuditAction asks what to do with the entries that hold secrets.
+func askAuditAction(count int) (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("[r]edact, [d]elete or [k]eep these %d entries? [k] ", count)
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "r", "redact":
+			return "redact", nil
+		case "d", "delete":
+			return "delete", nil
+		case "", "k", "keep":
+			return "keep", nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/daemon"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var backupKeep int
+
+func init() {
+	backupCmd.Flags().IntVar(&backupKeep, "keep", 10, "number of timestamped backups to keep in the backup directory, 0 keeps all")
+	rootCmd.AddCommand(backupCmd)
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup [dest]",
+	Short: "write a snapshot of the database",
+	Long: `backup writes a consistent snapshot of the database. Shells can keep inserting
+while it runs.
+
+Without dest, or when dest is a directory, the snapshot is named after the
+current time and only the newest --keep snapshots in that directory are kept.
+The default directory is backups next to the database, ~/.historian/backups.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dest := filepath.Join(filepath.Dir(HistorianDatabase), "backups")
+		if len(args) == 1 {
+			dest = args[0]
+		}
+		rotate := len(args) == 0 || strings.HasSuffix(dest, string(filepath.Separator))
+		if info, err := os.Stat(dest); err == nil && info.IsDir() {
+			rotate = true
+		}
+		dir := dest
+		if rotate {
+			if err := os.MkdirAll(dest, 0700); err != nil {
+				return err
+			}
+			dest = filepath.Join(dest, storage.BackupFileName(time.Now()))
+		}
+		dest, err := filepath.Abs(dest)
+		if err != nil {
+			return err
+		}
+
+		size, err := backup(dest)
+		if err != nil {
+			return fmt.Errorf("could not back up to %s: %w", dest, err)
+		}
+		fmt.Printf("backed up %s to %s\n", formatSize(size), dest)
+
+		if rotate && backupKeep > 0 {
+			removed, err := storage.RotateBackups(dir, backupKeep)
+			for _, file := range removed {
+				fmt.Printf("removed old backup %s\n", file)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// backupTimeout is how long the daemon gets to write a snapshot.
+const backupTimeout = 10 * time.Minute
+
+// backup lets the daemon write the snapshot when it is running, since it
+// holds the database.
+func backup(dest string) (int64, error) {
+	client, err := daemon.Dial(HistorianSocket, 50*time.Millisecond)
+	if err == nil {
+		defer client.Close()
+		// Copying a large database takes longer than a query.
+		client.SetTimeout(backupTimeout)
+		return client.Backup(dest)
+	}
+	store, err := openDatabase(storage.WithTimeout(lockTimeout))
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+	return store.Backup(dest)
+}
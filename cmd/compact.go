@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+func init() {
+	rootCmd.AddCommand(compactCmd)
+}
+
+var compactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "shrink the database file by rewriting it without its free pages",
+	Long: `bbolt never gives freed pages back to the filesystem, so the database keeps
+its size after entries are deleted or pruned. compact copies the database into
+a fresh file and swaps it in place of the original.
+
+compact waits a few seconds for other historian processes to release the
+database and gives up if they don't, stop the daemon before compacting.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		before, after, err := store.Compact()
+		if err != nil {
+			return fmt.Errorf("could not compact %s: %w", HistorianDatabase, err)
+		}
+		fmt.Printf("compacted %s from %s to %s\n", HistorianDatabase, formatSize(before), formatSize(after))
+		return nil
+	},
+}
+
+// formatSize prints a file size in the largest unit that keeps it above one.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/daemon"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var daemonDedup string
+
+func init() {
+	daemonCmd.Flags().StringVar(&daemonDedup, "dedup", "none", "how to treat repeated commands: none, ignoredups or erasedups")
+	rootCmd.AddCommand(daemonCmd)
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "own the database and answer the other historian commands over a unix socket",
+	Long: `daemon keeps the history database open and serves inserts and queries over
+a unix socket in ~/.historian. The other commands use it when it is running
+and open the database themselves when it is not.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dedup, err := storage.ParseDedupMode(daemonDedup)
+		if err != nil {
+			return err
+		}
+		store, err := openDatabase(storage.WithDedup(dedup))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		autoPrune(store)
+
+		listener, err := daemon.Listen(HistorianSocket)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(HistorianSocket)
+
+		stopping := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			logrus.Infof("received %s, shutting down", sig)
+			close(stopping)
+			listener.Close()
+		}()
+
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopping:
+					return
+				case <-ticker.C:
+					autoPrune(store)
+				}
+			}
+		}()
+
+		logrus.Infof("listening on %s", HistorianSocket)
+		err = daemon.NewServer(store).Serve(listener)
+		select {
+		case <-stopping:
+			return nil
+		default:
+			return err
+		}
+	},
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/config"
+	"github.com/svanellewee/historian/pkg/histfile"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	exportFormat    string
+	exportDirectory string
+	exportSince     string
+	exportUntil     string
+	exportMatch     []string
+	exportFile      string
+)
+
+// dateLayout is how --since and --until take a day.
+const dateLayout = "2006-01-02"
+
+func init() {
+	exportCmd.Flags().StringVar(&exportFormat, "format", string(histfile.JSON), "json, jsonl, csv, bash, zsh or fish")
+	exportCmd.Flags().StringVar(&exportDirectory, "dir", "", "only export this directory")
+	exportCmd.Flags().StringVar(&exportSince, "since", "", "only export entries from this day or time on, ie 2021-01-31, 2021-01-31T09:00:00Z, or an age like 30d")
+	exportCmd.Flags().StringVar(&exportUntil, "until", "", "only export entries up to the end of this day, or up to this time")
+	exportCmd.Flags().StringArrayVar(&exportMatch, "match", nil, "only export commands matching this regex (repeatable, every one has to match)")
+	exportCmd.Flags().StringVarP(&exportFile, "file", "f", "", "write to this file instead of stdout")
+	rootCmd.AddCommand(exportCmd)
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "write the history out as json, csv or a bash, zsh or fish history file",
+	Long: `export writes the entries selected by --dir, --since, --until and --match,
+oldest first, in the --format asked for:
+
+  json, jsonl  every entry with its annotation, exit status, duration, session,
+               host, user, shell and tty, as an array or as one entry per line
+  csv          the same, with a header row
+  bash         a history file with #<epoch> lines, as written with HISTTIMEFORMAT
+  zsh          a history file in the EXTENDED_HISTORY format
+  fish         a fish history file
+
+The shell formats only keep the commands and when they ran. Days are in the
+configured time zone.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := histfile.ParseFormat(exportFormat, histfile.ExportFormats)
+		if err != nil {
+			return err
+		}
+		since, until, err := exportRange()
+		if err != nil {
+			return err
+		}
+		filter, err := storage.GrepFilter(exportMatch...)
+		if err != nil {
+			return err
+		}
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var out io.Writer = os.Stdout
+		if exportFile != "" {
+			file, err := os.OpenFile(exportFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		writer, err := histfile.NewWriter(out, format)
+		if err != nil {
+			return err
+		}
+		err = store.Range(exportDirectory, since, until, func(history storage.History) error {
+			if !filter([]byte(history.DirectoryName), []byte(history.Key), []byte(history.Data)) {
+				return nil
+			}
+			return writer.Write(inZone(history))
+		})
+		if err != nil {
+			return err
+		}
+		return writer.Close()
+	},
+}
+
+// exportRange is the time range of --since and --until, everything when not given.
+func exportRange() (time.Time, time.Time, error) {
+	since := time.Time{}
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	var err error
+	if exportSince != "" {
+		if since, err = parseSince(exportSince); err != nil {
+			return since, until, err
+		}
+	}
+	if exportUntil != "" {
+		if until, err = parseUntil(exportUntil); err != nil {
+			return since, until, err
+		}
+	}
+	if until.Before(since) {
+		return since, until, fmt.Errorf("--until %s is before --since %s", exportUntil, exportSince)
+	}
+	return since, until, nil
+}
+
+// parseSince takes a day, a time or an age.
+func parseSince(value string) (time.Time, error) {
+	if day, err := time.ParseInLocation(dateLayout, value, location()); err == nil {
+		return day, nil
+	}
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp, nil
+	}
+	age, err := config.ParseAge(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a day like %s, a time like %s or an age", value, dateLayout, time.RFC3339)
+	}
+	return time.Now().Add(-age), nil
+}
+
+// parseUntil takes a day, which includes the whole day, or a time.
+func parseUntil(value string) (time.Time, error) {
+	if day, err := time.ParseInLocation(dateLayout, value, location()); err == nil {
+		_, eod := storage.DayBounds(day)
+		return eod, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a day like %s or a time like %s", value, dateLayout, time.RFC3339)
+	}
+	return timestamp, nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var fsckRepair bool
+
+func init() {
+	fsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "move bad records to the quarantine bucket and fix what can be fixed")
+	rootCmd.AddCommand(fsckCmd)
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "check the database for corruption and inconsistencies",
+	Long: `fsck checks the pages of the database file, then walks every bucket looking
+for keys that are not timestamps, values that do not decode or are not valid
+UTF-8, annotations without an entry, empty buckets and index entries that do
+not match the stored entries.
+
+With --repair bad records are moved to a quarantine bucket instead of being
+deleted, empty buckets are removed and the index is fixed. Corrupt pages can
+not be repaired, restore a backup instead.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		problems, err := store.Fsck(fsckRepair)
+		if err != nil {
+			return err
+		}
+		repaired := 0
+		for _, problem := range problems {
+			fmt.Println(problem)
+			if problem.Repair != "" {
+				repaired++
+			}
+		}
+		if len(problems) == 0 {
+			fmt.Println("no problems found")
+			return nil
+		}
+		if repaired < len(problems) {
+			if fsckRepair {
+				return fmt.Errorf("found %d problems, repaired %d", len(problems), repaired)
+			}
+			return fmt.Errorf("found %d problems, run historian fsck --repair to fix them", len(problems))
+		}
+		fmt.Printf("repaired %d problems\n", repaired)
+		return nil
+	},
+}
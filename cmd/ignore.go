@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/ignore"
+)
+
+func init() {
+	ignoreCmd.AddCommand(ignoreTestCmd)
+	rootCmd.AddCommand(ignoreCmd)
+}
+
+var ignoreCmd = &cobra.Command{
+	Use:   "ignore",
+	Short: "work with the rules that keep commands out of the history",
+	Long: `The ignore rules live in the [ignore] section of ~/.historian/config.toml:
+
+  [ignore]
+  patterns = ["ls", "cd *", "re:^git (status|diff)$"]
+  space = true       # commands typed with a leading space
+  self = true        # historian's own commands
+  min_length = 2
+  max_length = 2000
+
+Patterns are globs matching the whole command, like HISTIGNORE, or regular
+expressions when they start with "re:".`,
+}
+
+var ignoreTestCmd = &cobra.Command{
+	Use:   "test <command>",
+	Short: "tell whether a command would be stored",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if ignored, reason := ignoreRules().Match(args[0]); ignored {
+			fmt.Printf("ignored, %s\n", reason)
+			return nil
+		}
+		fmt.Println("stored")
+		return nil
+	},
+}
+
+// ignoreRules are the configured ignore rules. A broken pattern is reported
+// and left out.
+func ignoreRules() ignore.Rules {
+	configured := HistorianConfig.Ignore
+	rules := ignore.Rules{
+		Space:     configured.Space,
+		MinLength: configured.MinLength,
+		MaxLength: configured.MaxLength,
+	}
+	if configured.Self {
+		rules.Program = rootCmd.Name()
+	}
+	for _, source := range configured.Patterns {
+		pattern, err := ignore.NewPattern(source)
+		if err != nil {
+			logrus.Errorln(err)
+			continue
+		}
+		rules.Patterns = append(rules.Patterns, pattern)
+	}
+	return rules
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/histfile"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	importFormat    string
+	importDirectory string
+	importUndated   string
+	importPaths     []string
+	importDryRun    bool
+)
+
+func init() {
+	importCmd.Flags().StringVar(&importFormat, "format", string(histfile.Bash), "bash, zsh, fish or history-output")
+	importCmd.Flags().StringVar(&importDirectory, "dir", "", "directory of the entries that have none (default the current directory)")
+	importCmd.Flags().StringVar(&importUndated, "undated", "", "time of the first entry of a file without times, ie 2021-01-31 or 2021-01-31T09:00:00Z (default the file's modification time)")
+	importCmd.Flags().StringArrayVar(&importPaths, "map-path", nil, "rewrite directories starting with from to start with to, as from=to (repeatable, the first match wins)")
+	importCmd.Flags().BoolVarP(&importDryRun, "dry-run", "n", false, "report what would be imported without changing anything")
+	rootCmd.AddCommand(importCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "add the commands of a bash, zsh or fish history file",
+	Long: `import reads a shell's history file, or - for stdin, in the --format given:
+
+  bash            ~/.bash_history, with the #<epoch> lines HISTTIMEFORMAT adds
+  zsh             ~/.zsh_history, with or without EXTENDED_HISTORY
+  fish            ~/.local/share/fish/fish_history
+  history-output  the output of bash's history builtin, such as the file the
+                  history-store function of the README appends to
+
+History files do not record where commands ran, they are all imported into
+--dir. Commands the file has no time for, such as those of a bash history
+written without HISTTIMEFORMAT, are dated right after the command before them,
+or right before the first command with a time. In a file without any times
+they are dated from --undated on, in the order of the file.
+
+An entry of the same command, run in the same directory at the same time, is
+a duplicate and is not added again, so a file can be imported again after it
+grew. Give the same --dir and --undated for its undated commands to be found
+as duplicates as well. Ignore and redaction rules apply as they do to insert.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := histfile.ParseFormat(importFormat, histfile.ImportFormats)
+		if err != nil {
+			return err
+		}
+		paths, err := storage.ParsePathMap(importPaths)
+		if err != nil {
+			return err
+		}
+		directory, err := importDirectoryName()
+		if err != nil {
+			return err
+		}
+
+		in, undated, err := openHistoryFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if importUndated != "" {
+			if undated, err = parseSince(importUndated); err != nil {
+				return err
+			}
+		}
+		reader, err := histfile.NewReader(in, format)
+		if err != nil {
+			return err
+		}
+		read, err := reader.ReadAll()
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		histfile.Date(read, undated)
+
+		rules := ignoreRules()
+		entries := make([]storage.History, 0, len(read))
+		ignored := 0
+		for _, history := range read {
+			if matched, reason := rules.Match(history.Data); matched {
+				logrus.Debugf("not importing %q, %s", history.Data, reason)
+				ignored++
+				continue
+			}
+			if history.DirectoryName == "" {
+				history.DirectoryName = directory
+			}
+			entries = append(entries, history)
+		}
+
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		if !importDryRun {
+			autoPrune(store)
+		}
+		report, err := store.Import(entries, storage.ImportOptions{DryRun: importDryRun, Paths: paths})
+		if err != nil {
+			return err
+		}
+		if importDryRun {
+			fmt.Printf("would import %s: %s, %d ignored\n", args[0], report, ignored)
+			return nil
+		}
+		fmt.Printf("imported %s: %s, %d ignored\n", args[0], report, ignored)
+		return nil
+	},
+}
+
+// importDirectoryName is --dir made absolute, or the current directory.
+func importDirectoryName() (string, error) {
+	if importDirectory == "" {
+		return os.Getwd()
+	}
+	return filepath.Abs(importDirectory)
+}
+
+// openHistoryFile opens name, - being stdin, and returns when it was last
+// modified, now for stdin.
+func openHistoryFile(name string) (io.ReadCloser, time.Time, error) {
+	if name == "-" {
+		return ioutil.NopCloser(os.Stdin), time.Now(), nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, time.Time{}, err
+	}
+	return file, info.ModTime(), nil
+}
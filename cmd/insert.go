@@ -1,7 +1,13 @@
 package cmd
 
 import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/daemon"
 	"github.com/svanellewee/historian/pkg/storage"
 )
 
@@ -12,29 +18,133 @@ type entry struct {
 
 // ErrIncorrectCount describes incorrect number of arguments
 
+var (
+	insertExitCode int
+	insertStart    int64
+	insertEnd      int64
+	insertSession  string
+	insertShell    string
+	insertTTY      string
+	insertTimeout  time.Duration
+	insertDedup    string
+)
+
 func init() {
+	insertCmd.Flags().IntVar(&insertExitCode, "exit", 0, "exit status of the command, ie $?")
+	insertCmd.Flags().Int64Var(&insertStart, "start", 0, "unix time the command started (defaults to now)")
+	insertCmd.Flags().Int64Var(&insertEnd, "end", 0, "unix time the command finished")
+	insertCmd.Flags().StringVar(&insertSession, "session", "", "session id (defaults to $HISTORIAN_SESSION)")
+	insertCmd.Flags().StringVar(&insertShell, "shell", "", "shell name (defaults to the basename of $SHELL)")
+	insertCmd.Flags().StringVar(&insertTTY, "tty", "", "terminal the command ran on (defaults to $TTY)")
+	insertCmd.Flags().DurationVar(&insertTimeout, "timeout", 100*time.Millisecond, "how long to wait for a locked database before spooling the entry")
+	insertCmd.Flags().StringVar(&insertDedup, "dedup", "none", "how to treat repeated commands: none, ignoredups or erasedups")
 	rootCmd.AddCommand(insertCmd)
 }
 
+// insertOptions converts the insert flags that were set into history options.
+func insertOptions(cmd *cobra.Command) []storage.HistOption {
+	options := []storage.HistOption{}
+	flags := cmd.Flags()
+	if flags.Changed("exit") {
+		options = append(options, storage.SetExitCode(insertExitCode))
+	}
+	if flags.Changed("start") {
+		options = append(options, storage.SetTime(time.Unix(insertStart, 0)))
+	}
+	if flags.Changed("end") {
+		options = append(options, storage.SetEndTime(time.Unix(insertEnd, 0)))
+	}
+	if flags.Changed("session") {
+		options = append(options, storage.SetSession(insertSession))
+	}
+	if flags.Changed("shell") {
+		options = append(options, storage.SetShell(insertShell))
+	}
+	if flags.Changed("tty") {
+		options = append(options, storage.SetTTY(insertTTY))
+	}
+	return options
+}
+
 var insertCmd = &cobra.Command{
 	Use:   "insert",
 	Short: "insert entry into the database",
+	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		entry, err := storage.Convert(args[0])
 		if err != nil {
 			return err
 		}
+		// history 1 separates the number from the command with two spaces,
+		// Convert leaves the second one in front of the command.
+		typed := strings.TrimPrefix(entry.Data, " ")
+		if ignored, reason := ignoreRules().Match(typed); ignored {
+			logrus.Debugf("not storing %q, %s", typed, reason)
+			return nil
+		}
+		for _, option := range insertOptions(cmd) {
+			if err := option(entry); err != nil {
+				return err
+			}
+		}
+		// Masked here as well, the spool and the daemon are outside the store.
+		storage.Redact(entry, redactor())
 
-		store, err := storage.NewStore(HistorianDatabase)
+		dedup, err := storage.ParseDedupMode(insertDedup)
+		if err != nil {
+			return err
+		}
+		store, err := openInsertStore(storage.WithTimeout(insertTimeout), storage.WithDedup(dedup))
+		if errors.Is(err, storage.ErrLocked) {
+			// Never hold up the prompt, the next open merges the spool.
+			return spool(entry, dedup)
+		}
 		if err != nil {
 			return err
 		}
 		defer store.Close()
 
-		return store.Add(entry)
+		client, viaDaemon := store.(*daemon.Client)
+		if viaDaemon {
+			client.SetTimeout(insertTimeout)
+			err = client.AddDeduped(entry, dedup)
+		} else {
+			err = store.Add(entry)
+		}
+		if viaDaemon && daemon.IsTimeout(err) {
+			// A hung daemon must not hang the prompt. Once it was sent the
+			// entry, it may still add it, spooling it too could add it twice.
+			if daemon.IsUnanswered(err) {
+				logrus.Warnf("daemon did not answer in %s, it adds the entry when it catches up", insertTimeout)
+				return nil
+			}
+			logrus.Warnf("daemon did not take the entry in %s, spooling it", insertTimeout)
+			return spool(entry, dedup)
+		}
+		return err
 	},
 }
 
+// openInsertStore connects to the daemon, or opens the database without
+// applying the retention rules, see autoPrune.
+func openInsertStore(options ...storage.StoreOption) (storage.HistoryStore, error) {
+	client, err := daemon.Dial(HistorianSocket, daemonDialTimeout)
+	if err == nil {
+		return client, nil
+	}
+	return openDatabase(options...)
+}
+
+// spool queues entry for the next command that opens the database, which
+// applies mode to it.
+func spool(entry *storage.History, mode storage.DedupMode) error {
+	secret, err := databaseSecret()
+	if err != nil {
+		return err
+	}
+	return storage.AppendToSpool(HistorianSpool, entry, mode, secret)
+}
+
 /*
 function insert-hist () {
   $HOME/source/historian/historian insert "$(history 1)"
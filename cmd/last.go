@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 	"strconv"
 
@@ -9,7 +8,16 @@ import (
 	"github.com/svanellewee/historian/pkg/storage"
 )
 
+var (
+	lastVerbose bool
+	lastAll     bool
+	lastUnique  bool
+)
+
 func init() {
+	lastCmd.Flags().BoolVarP(&lastAll, "all", "a", false, "last entries across all directories")
+	lastCmd.Flags().BoolVarP(&lastVerbose, "verbose", "v", false, "show exit status, duration, host, user and shell")
+	lastCmd.Flags().BoolVarP(&lastUnique, "unique", "u", false, "show each distinct command once, with how often it ran")
 	rootCmd.AddCommand(lastCmd)
 }
 
@@ -25,24 +33,37 @@ var lastCmd = &cobra.Command{
 				return err
 			}
 		}
-		store, err := storage.NewStore(HistorianDatabase)
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
 		defer store.Close()
 
-		currentDirectory, err := os.Getwd()
-		if err != nil {
-			return err
+		currentDirectory := ""
+		if !lastAll {
+			currentDirectory, err = os.Getwd()
+			if err != nil {
+				return err
+			}
+		}
+		if lastUnique {
+			usages, err := store.Usage(currentDirectory)
+			if err != nil {
+				return err
+			}
+			if lastAll {
+				usages = storage.MergeUsage(usages)
+			}
+			if len(usages) > numCount {
+				usages = usages[:numCount]
+			}
+			return printUsage(usages)
 		}
 		history, err := store.Last(currentDirectory, numCount)
 		if err != nil {
 			return err
 		}
-		for _, elem := range history {
-			fmt.Printf("%s\n", elem)
-		}
-		return nil
+		return printHistory(history, lastVerbose)
 	},
 }
 
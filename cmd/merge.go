@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	mergeDryRun  bool
+	mergeKeyFile string
+	mergePaths   []string
+)
+
+// sourcePassphraseEnv holds the passphrase of an encrypted database merged from.
+const sourcePassphraseEnv = "HISTORIAN_SOURCE_PASSPHRASE"
+
+func init() {
+	mergeCmd.Flags().BoolVarP(&mergeDryRun, "dry-run", "n", false, "report what would be merged without changing anything")
+	mergeCmd.Flags().StringVar(&mergeKeyFile, "key-file", "", "key file of an encrypted source database")
+	mergeCmd.Flags().StringArrayVar(&mergePaths, "map-path", nil, "rewrite directories starting with from to start with to, as from=to (repeatable, the first match wins)")
+	rootCmd.AddCommand(mergeCmd)
+}
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge <other.db>",
+	Short: "add the history of another database, such as the one of an old laptop",
+	Long: `merge walks every directory of other.db and adds the entries missing from the
+database, along with their annotations and run counts. An entry of the same
+command, run in the same directory at the same time, with the same exit status,
+host, user, shell, terminal and session, is a duplicate and is not added again,
+though its annotation is copied when the existing entry has none. other.db itself is not changed.
+
+Directories are compared after applying the --map-path rules, so history from
+a machine that kept its checkouts elsewhere ends up in the right place:
+
+  historian merge --map-path /Users/alice/src=/home/alice/code old.db
+
+An encrypted other.db is unlocked with --key-file, $HISTORIAN_SOURCE_PASSPHRASE,
+or else the secret of the database merged into.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		source := args[0]
+		if _, err := os.Stat(source); err != nil {
+			return err
+		}
+		paths, err := storage.ParsePathMap(mergePaths)
+		if err != nil {
+			return err
+		}
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		if !mergeDryRun {
+			autoPrune(store)
+		}
+
+		options := storage.MergeOptions{DryRun: mergeDryRun, Paths: paths}
+		options.Secret, err = sourceSecret()
+		if err != nil {
+			return err
+		}
+		report, err := store.Merge(source, options)
+		if errors.Is(err, storage.ErrEncrypted) && options.Secret == nil {
+			// Most likely the same secret as this database's.
+			secret, secretErr := databaseSecret()
+			if secretErr != nil {
+				return secretErr
+			}
+			if secret != nil {
+				options.Secret = secret
+				report, err = store.Merge(source, options)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if mergeDryRun {
+			fmt.Printf("would merge %s: %s\n", source, report)
+			return nil
+		}
+		fmt.Printf("merged %s: %s\n", source, report)
+		return nil
+	},
+}
+
+// sourceSecret unlocks an encrypted database merged from, nil when none was given.
+func sourceSecret() (*storage.Secret, error) {
+	if mergeKeyFile != "" {
+		return storage.KeyFile(mergeKeyFile)
+	}
+	if passphrase := os.Getenv(sourcePassphraseEnv); passphrase != "" {
+		return storage.Passphrase(passphrase), nil
+	}
+	return nil, nil
+}
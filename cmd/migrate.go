@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var migrateDryRun bool
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "run the migrations without saving the result")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "upgrade the database file to the current schema version",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options, err := databaseOptions(storage.WithoutMigrations())
+		if err != nil {
+			return err
+		}
+		store, err := storage.NewStore(HistorianDatabase, options...)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		version, err := store.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("database schema version %d, current version %d\n", version, storage.SchemaVersion())
+
+		applied, err := store.Migrate(migrateDryRun)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("nothing to migrate")
+			return nil
+		}
+		for _, migration := range applied {
+			if migrateDryRun {
+				fmt.Printf("would migrate to version %d: %s\n", migration.Version, migration.Description)
+				continue
+			}
+			fmt.Printf("migrated to version %d: %s\n", migration.Version, migration.Description)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/svanellewee/historian/pkg/config"
+	"github.com/svanellewee/historian/pkg/histfile"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// location is the configured time zone, Load already rejected unknown zones.
+func location() *time.Location {
+	loc, err := HistorianConfig.Location()
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// inZone shows history's times in the configured time zone.
+func inZone(history storage.History) storage.History {
+	loc := location()
+	history.Time = history.Time.In(loc)
+	if !history.EndTime.IsZero() {
+		history.EndTime = history.EndTime.In(loc)
+	}
+	return history
+}
+
+// printHistory lists entries in the configured output format. Verbose adds
+// the recorded context to the text output, json always has it.
+func printHistory(entries []storage.History, verbose bool) error {
+	if HistorianConfig.Output == config.OutputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, history := range entries {
+			if err := encoder.Encode(histfile.NewEntry(inZone(history))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, history := range entries {
+		if verbose {
+			fmt.Println(inZone(history).Details())
+			continue
+		}
+		fmt.Println(inZone(history))
+	}
+	return nil
+}
+
+// printUsage lists distinct commands with their run counts.
+func printUsage(usages []storage.Usage) error {
+	loc := location()
+	if HistorianConfig.Output == config.OutputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, usage := range usages {
+			usage.FirstSeen = usage.FirstSeen.In(loc)
+			usage.LastSeen = usage.LastSeen.In(loc)
+			if err := encoder.Encode(usage); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, usage := range usages {
+		fmt.Printf("[%s] %5dx %s\n", usage.LastSeen.In(loc).Format(time.RFC3339), usage.Count, usage.Command)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/config"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	profileDatabase string
+	profileForce    bool
+)
+
+func init() {
+	profileCreateCmd.Flags().StringVar(&profileDatabase, "database", "", "database file of the profile (default history.db in the profile directory)")
+	profileDeleteCmd.Flags().BoolVarP(&profileForce, "force", "f", false, "delete the profile and its history")
+	profileCmd.AddCommand(profileListCmd, profileCreateCmd, profileUseCmd, profileDeleteCmd)
+	rootCmd.AddCommand(profileCmd)
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "manage profiles, each with its own database and settings",
+	Long: `Profiles keep separate histories, for instance for work and personal use.
+The default profile lives in ~/.historian, the others in
+~/.historian/profiles/<name>. A config.toml in a profile directory overrides
+the settings of ~/.historian/config.toml for that profile.
+
+The profile is chosen with --profile, $HISTORIAN_PROFILE or profile use, in
+that order.`,
+}
+
+var profileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the profiles, marking the one in use",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		profiles, err := config.Profiles(HistorianConfigPath)
+		if err != nil {
+			return err
+		}
+		for _, name := range profiles {
+			marker := " "
+			if name == HistorianProfile {
+				marker = "*"
+			}
+			database := HistorianDatabase
+			if name != HistorianProfile {
+				settings, err := loadProfileConfig(name)
+				if err != nil {
+					return fmt.Errorf("profile %s: %w", name, err)
+				}
+				database = settings.Database
+			}
+			fmt.Printf("%s %-16s %s\n", marker, name, database)
+		}
+		return nil
+	},
+}
+
+var profileCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "create a profile",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if config.ProfileExists(HistorianConfigPath, name) {
+			return fmt.Errorf("profile %s already exists", name)
+		}
+		dir, err := config.CreateProfile(HistorianConfigPath, name)
+		if err != nil {
+			return err
+		}
+		database := filepath.Join(dir, "history.db")
+		if profileDatabase != "" {
+			database, err = homedir.Expand(profileDatabase)
+			if err != nil {
+				return err
+			}
+			database, err = filepath.Abs(database)
+			if err != nil {
+				return err
+			}
+			settings := fmt.Sprintf("database = %q\n", database)
+			if err := ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(settings), 0600); err != nil {
+				return err
+			}
+		}
+		store, err := storage.NewStore(database)
+		if err != nil {
+			return err
+		}
+		store.Close()
+		fmt.Printf("created profile %s with database %s\n", name, database)
+		return nil
+	},
+}
+
+var profileUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "use a profile from now on",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := config.UseProfile(HistorianConfigPath, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("using profile %s\n", args[0])
+		return nil
+	},
+}
+
+var profileDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "delete a profile along with its history",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if !profileForce {
+			return fmt.Errorf("deleting profile %s deletes its history, pass --force to go ahead", name)
+		}
+		settings, err := loadProfileConfig(name)
+		if err != nil {
+			return err
+		}
+		if err := config.DeleteProfile(HistorianConfigPath, name); err != nil {
+			return err
+		}
+		fmt.Printf("deleted profile %s\n", name)
+		if dir := config.ProfileDir(HistorianConfigPath, name); filepath.Dir(settings.Database) != dir {
+			fmt.Printf("its database %s is outside the profile and was kept\n", settings.Database)
+		}
+		return nil
+	},
+}
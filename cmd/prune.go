@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/config"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	pruneOlderThan string
+	pruneKeepLast  int
+	pruneDirectory string
+	pruneMatch     string
+	pruneDryRun    bool
+)
+
+func init() {
+	pruneCmd.Flags().StringVar(&pruneOlderThan, "older-than", "", "remove entries older than this age, ie 2y, 90d, 12h")
+	pruneCmd.Flags().IntVar(&pruneKeepLast, "keep-last", 0, "keep only the last N entries of every directory")
+	pruneCmd.Flags().StringVar(&pruneDirectory, "dir", "", "only prune this directory")
+	pruneCmd.Flags().StringVar(&pruneMatch, "match", "", "only prune commands matching this regex")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "list what would be removed without removing it")
+	rootCmd.AddCommand(pruneCmd)
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "remove old entries and their annotations from the database",
+	Long: `prune removes the entries selected by --dir and --match that are older than
+--older-than or beyond the last --keep-last of their directory. Without
+--older-than and --keep-last every selected entry is removed.
+
+Retention rules can also be set in ~/.historian/config.toml, they are then
+applied automatically at most once a day:
+
+  [retention]
+  older_than = "2y"
+  keep_last = 10000`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policy := storage.PrunePolicy{
+			KeepLast:  pruneKeepLast,
+			Directory: pruneDirectory,
+		}
+		if pruneOlderThan != "" {
+			age, err := config.ParseAge(pruneOlderThan)
+			if err != nil {
+				return err
+			}
+			policy.OlderThan = age
+		}
+		if pruneMatch != "" {
+			re, err := regexp.Compile(pruneMatch)
+			if err != nil {
+				return err
+			}
+			policy.Match = re
+		}
+		if policy.Directory == "" && policy.Match == nil && policy.OlderThan == 0 && policy.KeepLast == 0 {
+			return fmt.Errorf("refusing to prune everything, pass at least one of --older-than, --keep-last, --dir or --match")
+		}
+
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		pruned, err := store.Prune(policy, pruneDryRun)
+		if err != nil {
+			return err
+		}
+		if pruneDryRun {
+			for _, history := range pruned {
+				fmt.Println(inZone(history))
+			}
+			fmt.Printf("would prune %d entries\n", len(pruned))
+			return nil
+		}
+		fmt.Printf("pruned %d entries\n", len(pruned))
+		return nil
+	},
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+	"golang.org/x/term"
+)
+
+var (
+	rekeyKeyFile    string
+	rekeyPassphrase bool
+	rekeyDecrypt    bool
+)
+
+// newPassphraseEnv holds the new passphrase for rekey when there is no terminal to ask on.
+const newPassphraseEnv = "HISTORIAN_NEW_PASSPHRASE"
+
+func init() {
+	rekeyCmd.Flags().StringVar(&rekeyKeyFile, "new-key-file", "", "encrypt with the key in this file")
+	rekeyCmd.Flags().BoolVar(&rekeyPassphrase, "new-passphrase", false, "encrypt with a passphrase, asked for or read from $"+newPassphraseEnv)
+	rekeyCmd.Flags().BoolVar(&rekeyDecrypt, "decrypt", false, "store the history unencrypted")
+	rootCmd.AddCommand(rekeyCmd)
+}
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "encrypt the database, change its key or decrypt it",
+	Long: `rekey encrypts every record, annotation and run count again with a new key
+file or passphrase, or decrypts them with --decrypt. The database is unlocked
+with the current key file or $HISTORIAN_PASSPHRASE, and compacted afterwards
+so no values sealed with the old key are left in it.
+
+A key file holds random bytes, for instance from
+
+  head -c 32 /dev/urandom > ~/.historian/key
+
+Point key_file in the [encryption] section of ~/.historian/config.toml at it
+once the database is rekeyed. A passphrase is read from $HISTORIAN_PASSPHRASE.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		chosen := 0
+		for _, set := range []bool{rekeyKeyFile != "", rekeyPassphrase, rekeyDecrypt} {
+			if set {
+				chosen++
+			}
+		}
+		if chosen != 1 {
+			return fmt.Errorf("pass one of --new-key-file, --new-passphrase or --decrypt")
+		}
+		var secret *storage.Secret
+		switch {
+		case rekeyKeyFile != "":
+			var err error
+			secret, err = storage.KeyFile(rekeyKeyFile)
+			if err != nil {
+				return err
+			}
+		case rekeyPassphrase:
+			passphrase, err := newPassphrase()
+			if err != nil {
+				return err
+			}
+			secret = storage.Passphrase(passphrase)
+		}
+
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		if err := store.Rekey(secret); err != nil {
+			return fmt.Errorf("could not rekey %s: %w", HistorianDatabase, err)
+		}
+		if _, _, err := store.Compact(); err != nil {
+			return fmt.Errorf("rekeyed %s but could not compact it: %w", HistorianDatabase, err)
+		}
+		switch {
+		case rekeyKeyFile != "":
+			fmt.Printf("encrypted %s with %s, set key_file in the [encryption] section of your config\n", HistorianDatabase, rekeyKeyFile)
+		case rekeyPassphrase:
+			fmt.Printf("encrypted %s with the new passphrase, set $%s to it and remove key_file from your config\n", HistorianDatabase, passphraseEnv)
+		default:
+			fmt.Printf("decrypted %s, remove key_file from your config and unset $%s\n", HistorianDatabase, passphraseEnv)
+		}
+		return nil
+	},
+}
+
+// newPassphrase asks for the new passphrase twice, unless it is in the environment.
+func newPassphrase() (string, error) {
+	if passphrase := os.Getenv(newPassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no terminal to ask for the passphrase, set $%s", newPassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "new passphrase: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "repeat passphrase: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(first, second) {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	if len(first) == 0 {
+		return "", fmt.Errorf("the passphrase is empty")
+	}
+	return string(first), nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "replace the database with a backup",
+	Long: `restore checks that file is an intact historian database and puts it in place
+of the current one. The current database is kept as history.db.pre-restore, so
+a restore can be undone by restoring that file. The restored database syncs
+under a new machine id, as its history is behind the one synced before.
+
+Stop the daemon before restoring.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshot := args[0]
+		version, err := storage.ValidateBackup(snapshot)
+		if err != nil {
+			return err
+		}
+
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		// Restoring the previous pre-restore file must not overwrite it first.
+		previous := HistorianDatabase + ".pre-restore"
+		if _, err := store.Backup(previous + ".new"); err != nil {
+			return fmt.Errorf("could not back up the current database: %w", err)
+		}
+		if err := store.Restore(snapshot); err != nil {
+			if errors.Is(err, storage.ErrRestoreIncomplete) {
+				if moveErr := os.Rename(previous+".new", HistorianDatabase); moveErr != nil {
+					return fmt.Errorf("could not restore %s: %w, nor put the previous database back from %s: %v", snapshot, err, previous+".new", moveErr)
+				}
+				return fmt.Errorf("could not restore %s, put the previous database back: %w", snapshot, err)
+			}
+			os.Remove(previous + ".new")
+			return fmt.Errorf("could not restore %s: %w", snapshot, err)
+		}
+		if err := os.Rename(previous+".new", previous); err != nil {
+			return err
+		}
+		fmt.Printf("kept the previous database as %s\n", previous)
+		fmt.Printf("restored %s (schema version %d)\n", snapshot, version)
+		return nil
+	},
+}
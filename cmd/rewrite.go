@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	rewriteDryRun bool
+	rewritePaths  []string
+)
+
+func init() {
+	rewritePathsCmd.Flags().BoolVarP(&rewriteDryRun, "dry-run", "n", false, "list the directories that would move without moving them")
+	rewritePathsCmd.Flags().StringArrayVar(&rewritePaths, "map-path", nil, "rewrite directories starting with from to start with to, as from=to (repeatable, the first match wins)")
+	rootCmd.AddCommand(rewritePathsCmd)
+}
+
+var rewritePathsCmd = &cobra.Command{
+	Use:   "rewrite-paths",
+	Short: "move history recorded under old directories to new ones",
+	Long: `rewrite-paths moves the entries, annotations and run counts of every directory
+matching a --map-path rule to the rewritten directory, joining any history
+already there. Rules match whole path components and are tried in order:
+
+  historian rewrite-paths \
+    --map-path /Users/alice/src/work=/home/alice/work \
+    --map-path /Users/alice/src=/home/alice/code
+
+An entry of the same command, run at the same time, that is already in the
+new directory is dropped as a duplicate.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(rewritePaths) == 0 {
+			return fmt.Errorf("pass at least one --map-path from=to")
+		}
+		paths, err := storage.ParsePathMap(rewritePaths)
+		if err != nil {
+			return err
+		}
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		moves, err := store.RewritePaths(paths, rewriteDryRun)
+		if err != nil {
+			return err
+		}
+		entries := 0
+		for _, move := range moves {
+			fmt.Printf("%s -> %s: %d entries, %d duplicates\n", move.From, move.To, move.Entries, move.Duplicates)
+			entries += move.Entries
+		}
+		if rewriteDryRun {
+			fmt.Printf("would move %d entries out of %d directories\n", entries, len(moves))
+			return nil
+		}
+		fmt.Printf("moved %d entries out of %d directories\n", entries, len(moves))
+		return nil
+	},
+}
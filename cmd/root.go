@@ -2,41 +2,210 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/config"
+	"github.com/svanellewee/historian/pkg/daemon"
+	"github.com/svanellewee/historian/pkg/redact"
 	"github.com/svanellewee/historian/pkg/storage"
 )
 
 var (
 	// HistorianConfigPath is the directory where all the historian data files are stored
 	HistorianConfigPath string
+	// HistorianProfile is the profile in use, HistorianProfilePath its directory
+	HistorianProfile     string
+	HistorianProfilePath string
 	// HistorianDatabase is the actual location of the history file
 	HistorianDatabase string
-	rootCmd           = &cobra.Command{
+	// HistorianSpool queues inserts made while the database was locked
+	HistorianSpool string
+	// HistorianSocket is where the daemon listens
+	HistorianSocket string
+	// HistorianConfig holds the settings from the config file, the
+	// environment and the global flags
+	HistorianConfig = &config.Config{}
+	configFile      string
+	profileFlag     string
+	rootCmd         = &cobra.Command{
 		Use:   "historian",
 		Short: "historian is a replacement for your bash history",
 		Long:  `historian stores your history into a queryable database`,
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Println("Historian")
-			initHomeDir()
 		},
 	}
 )
 
+// configEnv names a config file to read instead of the one in ~/.historian.
+const configEnv = "HISTORIAN_CONFIG"
+
+func init() {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&profileFlag, "profile", "", "profile to use (default $"+config.ProfileEnv+", or the one chosen with profile use)")
+	flags.StringVar(&configFile, "config", "", "config file (default ~/.historian/config.toml, or $"+configEnv+")")
+	flags.String("db", "", "history database file (default ~/.historian/history.db)")
+	flags.String("output", "", "how entries are listed: text or json (default text)")
+	flags.String("timezone", "", "time zone times are shown in, such as UTC (default local)")
+	cobra.OnInitialize(initHomeDir)
+}
+
 // Execute root command
 func Execute() {
-	initHomeDir()
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// openStore connects to the daemon for the commands that only need the
+// storage.HistoryStore operations, or opens the database itself when no
+// daemon is running, applying the retention rules when they are due.
+func openStore(options ...storage.StoreOption) (storage.HistoryStore, error) {
+	client, err := daemon.Dial(HistorianSocket, daemonDialTimeout)
+	if err == nil {
+		return client, nil
+	}
+	store, err := openDatabase(options...)
+	if err != nil {
+		return nil, err
+	}
+	autoPrune(store)
+	return store, nil
+}
+
+// daemonDialTimeout is how long commands wait to find out whether the daemon
+// is running.
+const daemonDialTimeout = 50 * time.Millisecond
+
+// lockTimeout is how long maintenance commands wait for the database.
+const lockTimeout = 5 * time.Second
+
+// openDatabase opens the history database file and merges in any spooled
+// inserts. The retention rules are left to the daemon and the everyday
+// commands, see autoPrune.
+func openDatabase(options ...storage.StoreOption) (*storage.Store, error) {
+	options, err := databaseOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.NewStore(HistorianDatabase, options...)
+	if errors.Is(err, storage.ErrLocked) {
+		return nil, fmt.Errorf("%w, is historian daemon running?", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	count, err := store.DrainSpool(HistorianSpool)
+	if err != nil {
+		logrus.Errorf("could not merge spooled entries from %s: %v", HistorianSpool, err)
+	} else if count > 0 {
+		logrus.Debugf("merged %d spooled entries", count)
+	}
+	return store, nil
+}
+
+// passphraseEnv holds the passphrase of an encrypted database that is not
+// unlocked with a key file.
+const passphraseEnv = "HISTORIAN_PASSPHRASE"
+
+// databaseOptions adds the configured redaction rules and the secret of an
+// encrypted database to options.
+func databaseOptions(options ...storage.StoreOption) ([]storage.StoreOption, error) {
+	configured := []storage.StoreOption{storage.WithRedactor(redactor())}
+	secret, err := databaseSecret()
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		configured = append(configured, storage.WithSecret(secret))
+	}
+	return append(configured, options...), nil
+}
+
+// redactor applies the built-in and configured redaction rules. A broken rule
+// is reported and left out, rather than keeping commands from being stored.
+func redactor() *redact.Redactor {
+	redaction := HistorianConfig.Redaction
+	if redaction.Disabled {
+		return nil
+	}
+	rules := []redact.Rule{}
+	if !redaction.SkipBuiltin {
+		rules = append(rules, redact.Builtin()...)
+	}
+	for _, configured := range redaction.Rules {
+		rule, err := redact.NewRule(configured.Name, configured.Pattern)
+		if err != nil {
+			logrus.Errorln(err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return redact.New(rules...)
+}
+
+// databaseSecret is the configured key file, or the passphrase from the
+// environment, nil when the database is not encrypted.
+func databaseSecret() (*storage.Secret, error) {
+	if keyFile := HistorianConfig.Encryption.KeyFile; keyFile != "" {
+		keyFile, err := homedir.Expand(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return storage.KeyFile(keyFile)
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return storage.Passphrase(passphrase), nil
+	}
+	return nil, nil
+}
+
+// autoPruneInterval is how often the configured retention rules are applied.
+const autoPruneInterval = 24 * time.Hour
+
+// retentionPolicy converts the configured retention rules to a prune policy.
+func retentionPolicy() (storage.PrunePolicy, error) {
+	retention := HistorianConfig.Retention
+	policy := storage.PrunePolicy{KeepLast: retention.KeepLast}
+	if retention.OlderThan != "" {
+		age, err := config.ParseAge(retention.OlderThan)
+		if err != nil {
+			return policy, fmt.Errorf("retention: %w", err)
+		}
+		policy.OlderThan = age
+	}
+	return policy, nil
+}
+
+// autoPrune applies the configured retention rules at most once a day. The
+// daemon and the commands that read or add history call it, not insert, which
+// must not hold up the prompt, nor the maintenance commands such as backup,
+// restore and fsck, which must not change what they work on.
+func autoPrune(store *storage.Store) {
+	if !HistorianConfig.Retention.Enabled() {
+		return
+	}
+	policy, err := retentionPolicy()
+	if err != nil {
+		logrus.Errorln(err)
+		return
+	}
+	pruned, entries, err := store.AutoPrune(policy, autoPruneInterval)
+	if err != nil {
+		logrus.Errorf("could not apply retention rules: %v", err)
+	} else if pruned {
+		logrus.Debugf("retention rules pruned %d entries", len(entries))
+	}
+}
+
 func initHomeDir() {
 	home, err := homedir.Dir()
 	if err != nil {
@@ -48,14 +217,30 @@ func initHomeDir() {
 		logrus.Infof("Creating directory at %s", HistorianConfigPath)
 		os.Mkdir(HistorianConfigPath, 0777)
 	}
+	// Carrying on without the profile or the config could mean writing to
+	// the wrong database.
+	HistorianProfile, err = selectProfile()
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	HistorianProfilePath = config.ProfileDir(HistorianConfigPath, HistorianProfile)
+	HistorianConfig, err = loadConfig(HistorianProfilePath)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
 
-	HistorianDatabase = path.Join(HistorianConfigPath, "history.db")
+	HistorianDatabase = HistorianConfig.Database
+	// The spool and the socket belong to the database, not to the config.
+	dataDir := path.Dir(HistorianDatabase)
+	HistorianSpool = path.Join(dataDir, "spool.jsonl")
+	HistorianSocket = path.Join(dataDir, "historian.sock")
 	if _, err = os.Stat(HistorianDatabase); err != nil {
 		if os.IsNotExist(err) {
 			logrus.Infof("Attempting database creation at %s", HistorianDatabase)
 			store, err := storage.NewStore(HistorianDatabase)
 			if err != nil {
 				logrus.Errorf("could not create history database %v", err)
+				return
 			}
 			defer store.Close()
 		} else {
@@ -63,3 +248,71 @@ func initHomeDir() {
 		}
 	}
 }
+
+// selectProfile is the profile given with --profile, $HISTORIAN_PROFILE or
+// profile use, in that order. A mistyped name is an error rather than a new,
+// empty history.
+func selectProfile() (string, error) {
+	name := profileFlag
+	if name == "" {
+		name = os.Getenv(config.ProfileEnv)
+	}
+	if name == "" {
+		current, err := config.CurrentProfile(HistorianConfigPath)
+		if err != nil {
+			return "", err
+		}
+		name = current
+	}
+	if err := config.ValidateProfileName(name); err != nil {
+		return "", err
+	}
+	if !config.ProfileExists(HistorianConfigPath, name) {
+		return "", fmt.Errorf("%w %q, create it with historian profile create %s", config.ErrUnknownProfile, name, name)
+	}
+	return name, nil
+}
+
+// loadConfig reads the settings, with --config or $HISTORIAN_CONFIG in place
+// of the config file in the historian directory, then the settings of the
+// profile in profileDir and the global flags on top.
+func loadConfig(profileDir string) (*config.Config, error) {
+	flags := rootCmd.PersistentFlags()
+	return loadSettings(
+		config.WithProfile(profileDir),
+		config.WithFlag("database", flags.Lookup("db")),
+		config.WithFlag("output", flags.Lookup("output")),
+		config.WithFlag("timezone", flags.Lookup("timezone")),
+	)
+}
+
+// loadProfileConfig reads the settings of a profile other than the one in
+// use, leaving out the environment and the global flags that are meant for it.
+func loadProfileConfig(name string) (*config.Config, error) {
+	return loadSettings(config.WithProfile(config.ProfileDir(HistorianConfigPath, name)), config.WithoutEnv())
+}
+
+// loadSettings reads the settings with options, and --config or
+// $HISTORIAN_CONFIG in place of the config file in the historian directory.
+func loadSettings(options ...config.Option) (*config.Config, error) {
+	file := configFile
+	if file == "" {
+		file = os.Getenv(configEnv)
+	}
+	if file != "" {
+		file, err := homedir.Expand(file)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, config.WithFile(file))
+	}
+	settings, err := config.Load(HistorianConfigPath, options...)
+	if err != nil {
+		return nil, err
+	}
+	settings.Database, err = homedir.Expand(settings.Database)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
@@ -1,13 +1,18 @@
 package cmd
 
 import (
-	"fmt"
-
 	"github.com/spf13/cobra"
 	"github.com/svanellewee/historian/pkg/storage"
 )
 
+var (
+	searchVerbose bool
+	searchUnique  bool
+)
+
 func init() {
+	searchCmd.Flags().BoolVarP(&searchUnique, "unique", "u", false, "show each distinct command once, with how often it ran")
+	searchCmd.Flags().BoolVarP(&searchVerbose, "verbose", "v", false, "show exit status, duration, host, user and shell")
 	rootCmd.AddCommand(searchCmd)
 }
 
@@ -16,20 +21,34 @@ var searchCmd = &cobra.Command{
 	Short: "search an entry into the database, using regex. Add more regexes to filter further",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var err error
-		store, err := storage.NewStore(HistorianDatabase)
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
 		defer store.Close()
 
+		if searchUnique {
+			filter, err := storage.GrepFilter(args...)
+			if err != nil {
+				return err
+			}
+			usages, err := store.Usage("")
+			if err != nil {
+				return err
+			}
+			matches := []storage.Usage{}
+			for _, usage := range storage.MergeUsage(usages) {
+				if filter(nil, nil, []byte(usage.Command)) {
+					matches = append(matches, usage)
+				}
+			}
+			return printUsage(matches)
+		}
 		history, err := store.Greps(args...)
 		if err != nil {
 			return err
 		}
-		for _, elem := range history {
-			fmt.Printf("%s\n", elem)
-		}
-		return nil
+		return printHistory(history, searchVerbose)
 	},
 }
 
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/httpsync"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	serveSync   bool
+	serveListen string
+	syncToken   string
+)
+
+// syncTokenEnv holds the token of the sync server when no --token-file is given.
+const syncTokenEnv = "HISTORIAN_SYNC_TOKEN"
+
+func init() {
+	serveCmd.Flags().BoolVar(&serveSync, "sync", false, "serve the sync protocol for historian sync --url")
+	serveCmd.Flags().StringVar(&serveListen, "listen", "127.0.0.1:8765", "address to listen on")
+	serveCmd.Flags().StringVar(&syncToken, "token-file", "", "file holding the token clients authenticate with (default $"+syncTokenEnv+")")
+	rootCmd.AddCommand(serveCmd)
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve the database over HTTP",
+	Long: `serve --sync makes this database the central server for machines running
+historian sync --url. Clients push the commands they recorded and pull the
+ones the others pushed. Every request must carry the token, read from
+--token-file or $HISTORIAN_SYNC_TOKEN, which the clients need as well.
+
+The server holds its database open, give it one of its own with --db or a
+profile. Put it behind a TLS terminating proxy when it is reachable from
+outside. An encrypted database cannot serve sync, changes are exchanged in
+plain text.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !serveSync {
+			return fmt.Errorf("pass --sync, the sync protocol is all serve offers")
+		}
+		token, err := readSyncToken()
+		if err != nil {
+			return err
+		}
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		if store.Encrypted() {
+			return storage.ErrSyncEncrypted
+		}
+		autoPrune(store)
+
+		server := &http.Server{Addr: serveListen, Handler: httpsync.NewHandler(store, token)}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			logrus.Infof("received %s, shutting down", sig)
+			server.Shutdown(context.Background())
+		}()
+
+		logrus.Infof("serving sync for %s on %s", HistorianDatabase, serveListen)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+// readSyncToken reads the token from --token-file or $HISTORIAN_SYNC_TOKEN.
+func readSyncToken() (string, error) {
+	token := os.Getenv(syncTokenEnv)
+	if syncToken != "" {
+		contents, err := ioutil.ReadFile(syncToken)
+		if err != nil {
+			return "", err
+		}
+		token = string(contents)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("no sync token, pass --token-file or set $%s", syncTokenEnv)
+	}
+	return token, nil
+}
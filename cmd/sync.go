@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/httpsync"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	syncRemote       string
+	syncURL          string
+	syncNewMachineID bool
+)
+
+func init() {
+	syncCmd.Flags().StringVar(&syncRemote, "remote", "", "sync directory shared with the other machines")
+	syncCmd.Flags().StringVar(&syncURL, "url", "", "sync server started with historian serve --sync")
+	syncCmd.Flags().BoolVar(&syncNewMachineID, "new-machine-id", false, "sync under a new machine id, for a copy of another machine's database")
+	syncCmd.Flags().StringVar(&syncToken, "token-file", "", "file holding the token of the sync server (default $"+syncTokenEnv+")")
+	rootCmd.AddCommand(syncCmd)
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "exchange history with other machines through a shared directory or a server",
+	Long: `sync writes the commands recorded on this machine since the last sync to a
+new change file in a directory of its own under --remote, then imports the
+change files the other machines wrote since. The remote can be a mounted
+share, a Syncthing folder or a git checkout, every machine only ever adds
+files to it.
+
+Each machine keeps track of how far it got per remote, so running sync often
+is cheap. Entries already present are recognised as duplicates. Change files
+are not encrypted, so an encrypted database refuses to sync.
+
+With --url, sync pushes to and pulls from a server started with
+historian serve --sync instead, authenticating with the token from
+--token-file or $HISTORIAN_SYNC_TOKEN.
+
+A database copied to another machine syncs under the same machine id as the
+original, which sync notices and refuses. Run sync with --new-machine-id on
+the copy to carry on. Restoring a backup gives the database a new id.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if (syncRemote == "") == (syncURL == "") {
+			return fmt.Errorf("pass either --remote with the sync directory or --url with the sync server")
+		}
+		var client *httpsync.Client
+		if syncURL != "" {
+			token, err := readSyncToken()
+			if err != nil {
+				return err
+			}
+			client = httpsync.NewClient(syncURL, token)
+		}
+		store, err := openDatabase(storage.WithTimeout(lockTimeout))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		autoPrune(store)
+
+		if syncNewMachineID {
+			id, err := store.NewMachineID()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("syncing as %s\n", id)
+		}
+		if client != nil {
+			report, err := client.Sync(store)
+			if err != nil {
+				return duplicateMachineHint(err)
+			}
+			fmt.Printf("synced with %s: %s\n", syncURL, report)
+			return nil
+		}
+		report, err := store.SyncDir(syncRemote)
+		if err != nil {
+			return duplicateMachineHint(err)
+		}
+		fmt.Printf("synced with %s: %s\n", syncRemote, report)
+		return nil
+	},
+}
+
+// duplicateMachineHint tells how to get out of syncing a copied database.
+func duplicateMachineHint(err error) error {
+	if errors.Is(err, storage.ErrDuplicateMachineID) {
+		return fmt.Errorf("%w, run historian sync --new-machine-id on the one that was copied", err)
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/historian/pkg/daemon"
+	"github.com/svanellewee/historian/pkg/histfile"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+var (
+	watchHistfile string
+	watchFormat   string
+	watchDir      string
+	watchInterval time.Duration
+	watchOnce     bool
+)
+
+func init() {
+	watchCmd.Flags().StringVar(&watchHistfile, "histfile", "", "history file to follow (default $HISTFILE, or ~/.bash_history)")
+	watchCmd.Flags().StringVar(&watchFormat, "format", string(histfile.Bash), "bash, zsh, fish or history-output")
+	watchCmd.Flags().StringVar(&watchDir, "dir", "", "directory of the entries (default the home directory)")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", time.Second, "how often to check the file for new entries")
+	watchCmd.Flags().BoolVar(&watchOnce, "once", false, "add what is new in the file and exit")
+	rootCmd.AddCommand(watchCmd)
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "follow a shell's history file and add the commands appended to it",
+	Long: `watch is an alternative to calling historian insert from PROMPT_COMMAND: it
+follows the history file as the shell appends to it, and adds the new
+commands with the times the shell recorded. For bash, set HISTTIMEFORMAT so
+it records them, and shopt -s histappend; with PROMPT_COMMAND="history -a"
+commands are written as they run rather than when the shell exits.
+
+How far the file was read is kept in the database, so watch carries on where
+it stopped after a restart. A file truncated to HISTFILESIZE or replaced by a
+new one is read from the start again, where entries with a time that were
+added before are found as duplicates. Commands without a time are dated when
+they are read.
+
+When the daemon is running, the entries are added through it. Otherwise the
+database is only opened when there is something to add, and when it is locked
+watch tries again on the next check.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := histfile.ParseFormat(watchFormat, histfile.ImportFormats)
+		if err != nil {
+			return err
+		}
+		histfilePath, err := watchHistfilePath()
+		if err != nil {
+			return err
+		}
+		directory := watchDir
+		if directory == "" {
+			directory, err = homedir.Dir()
+		} else {
+			directory, err = filepath.Abs(directory)
+		}
+		if err != nil {
+			return err
+		}
+
+		secret, err := databaseSecret()
+		if err != nil {
+			return err
+		}
+		watcher := &histfileWatcher{
+			path:      histfilePath,
+			format:    format,
+			directory: directory,
+			cursor:    "watch:" + histfilePath,
+			secret:    secret,
+		}
+		defer watcher.close()
+		if err := watcher.load(); err != nil {
+			return err
+		}
+		if watchOnce {
+			return watcher.poll()
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		logrus.Infof("watching %s", histfilePath)
+		for {
+			if err := watcher.poll(); err != nil {
+				logrus.Errorf("could not read %s: %v", histfilePath, err)
+			}
+			select {
+			case sig := <-signals:
+				logrus.Infof("received %s, shutting down", sig)
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// watchHistfilePath is --histfile, $HISTFILE or ~/.bash_history, made absolute.
+func watchHistfilePath() (string, error) {
+	path := watchHistfile
+	if path == "" {
+		path = os.Getenv("HISTFILE")
+	}
+	if path == "" {
+		path = "~/.bash_history"
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// histfileWatcher adds the entries appended to a history file, keeping how
+// far it got in the cursor.
+type histfileWatcher struct {
+	path      string
+	format    histfile.Format
+	directory string
+	cursor    string
+	position  histfile.Position
+	// secret is kept between opens of the database, so a passphrase is only
+	// stretched once.
+	secret *storage.Secret
+	daemon *daemon.Client
+}
+
+// importStore is what the entries are added to, the daemon or the database.
+type importStore interface {
+	Import(entries []storage.History, options storage.ImportOptions) (storage.ImportReport, error)
+	Cursor(name string) (string, error)
+}
+
+// open returns the daemon when it is running, or the database, and what to
+// call when done with it.
+func (w *histfileWatcher) open() (importStore, func(), error) {
+	if w.daemon == nil {
+		if client, err := daemon.Dial(HistorianSocket, daemonDialTimeout); err == nil {
+			w.daemon = client
+		}
+	}
+	if w.daemon != nil {
+		return w.daemon, func() {}, nil
+	}
+	options := []storage.StoreOption{storage.WithTimeout(lockTimeout)}
+	if w.secret != nil {
+		options = append(options, storage.WithSecret(w.secret))
+	}
+	store, err := openDatabase(options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, store.Close, nil
+}
+
+// failed forgets the daemon after a request to it failed, it may have been
+// stopped. The next poll opens the database instead.
+func (w *histfileWatcher) failed(store importStore) {
+	if _, viaDaemon := store.(*daemon.Client); viaDaemon {
+		w.daemon.Close()
+		w.daemon = nil
+	}
+}
+
+func (w *histfileWatcher) close() {
+	if w.daemon != nil {
+		w.daemon.Close()
+	}
+}
+
+// load reads the position kept in the database.
+func (w *histfileWatcher) load() error {
+	store, done, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer done()
+	position, err := store.Cursor(w.cursor)
+	if err != nil {
+		w.failed(store)
+		return err
+	}
+	w.position, err = histfile.ParsePosition(position)
+	return err
+}
+
+// poll adds what was appended since the last poll. A missing file is not an
+// error, it is being rotated or the shell did not write it yet.
+func (w *histfileWatcher) poll() error {
+	entries, next, reset, err := histfile.ReadFrom(w.path, w.format, w.position)
+	if os.IsNotExist(err) {
+		logrus.Debugf("%s does not exist", w.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if reset {
+		logrus.Infof("%s was truncated or replaced, reading it from the start", w.path)
+	}
+	if next == w.position {
+		return nil
+	}
+	histfile.Date(entries, time.Now())
+
+	rules := ignoreRules()
+	kept := make([]storage.History, 0, len(entries))
+	for _, history := range entries {
+		if ignored, reason := rules.Match(history.Data); ignored {
+			logrus.Debugf("not storing %q, %s", history.Data, reason)
+			continue
+		}
+		history.DirectoryName = w.directory
+		kept = append(kept, history)
+	}
+
+	store, done, err := w.open()
+	if errors.Is(err, storage.ErrLocked) {
+		logrus.Warnf("%v, trying again later", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer done()
+	report, err := store.Import(kept, storage.ImportOptions{Cursor: w.cursor, Position: next.String()})
+	if err != nil {
+		w.failed(store)
+		return err
+	}
+	w.position = next
+	if report.Added > 0 {
+		logrus.Debugf("added %d entries from %s", report.Added, w.path)
+	}
+	return nil
+}
@@ -6,7 +6,10 @@ require (
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/cobra v1.1.1
-	github.com/spf13/viper v1.7.0 // indirect
+	github.com/spf13/pflag v1.0.5
+	github.com/spf13/viper v1.7.0
 	github.com/stretchr/testify v1.3.0
 	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
@@ -1,21 +1,270 @@
+// Package config loads historian's settings from the config file in the
+// historian directory, the environment and the command line.
 package config
 
-// var (
-// 	// HistorianConfigPath is the directory where all the historian data files are stored
-// 	HistorianConfigPath string
-// 	// HistorianDatabase is the actual location of the history file
-// 	HistorianDatabase string
-// )
-
-// func init() {
-// 	home, err := homedir.Dir()
-// 	if err != nil {
-// 		logrus.Errorln(err)
-// 	}
-// 	HistorianConfigPath = path.Join(home, ".historian")
-// 	if _, err := os.Stat(HistorianConfigPath); os.IsNotExist(err) {
-// 		os.Mkdir(HistorianConfigPath, 0600)
-// 	}
-// 	HistorianDatabase = path.Join(HistorianConfigPath, "history.db")
-
-// }
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Retention decides what is pruned automatically. Empty values keep everything.
+type Retention struct {
+	// OlderThan is an age such as "2y", "90d" or "12h".
+	OlderThan string `mapstructure:"older_than"`
+	// KeepLast is how many entries every directory keeps.
+	KeepLast int `mapstructure:"keep_last"`
+}
+
+// Enabled reports whether any retention rule is set.
+func (r Retention) Enabled() bool {
+	return r.OlderThan != "" || r.KeepLast > 0
+}
+
+// Encryption decides how an encrypted database is unlocked. Without a key
+// file the passphrase is read from $HISTORIAN_PASSPHRASE.
+type Encryption struct {
+	KeyFile string `mapstructure:"key_file"`
+}
+
+// RedactionRule is a user defined redaction rule. The pattern is a regular
+// expression, a (?P<secret>...) group limits the masking to that group.
+type RedactionRule struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+}
+
+// Redaction decides which secrets are masked before commands are stored.
+type Redaction struct {
+	// Disabled stores commands as they are.
+	Disabled bool `mapstructure:"disabled"`
+	// SkipBuiltin only applies Rules, not the built-in rules.
+	SkipBuiltin bool            `mapstructure:"skip_builtin"`
+	Rules       []RedactionRule `mapstructure:"rules"`
+}
+
+// Ignore decides which commands insert does not store.
+type Ignore struct {
+	// Patterns are globs matching whole commands, like HISTIGNORE, or
+	// regular expressions when prefixed with "re:".
+	Patterns []string `mapstructure:"patterns"`
+	// Space ignores commands typed with a leading space.
+	Space     bool `mapstructure:"space"`
+	MinLength int  `mapstructure:"min_length"`
+	MaxLength int  `mapstructure:"max_length"`
+	// Self ignores historian's own commands.
+	Self bool `mapstructure:"self"`
+}
+
+// Config holds every setting.
+type Config struct {
+	// Database is the history database file.
+	Database string `mapstructure:"database"`
+	// TimeZone is the zone times are shown in, and days start in, such as
+	// "UTC" or "Europe/Amsterdam". Empty is the local zone.
+	TimeZone string `mapstructure:"timezone"`
+	// Output is how entries are listed, "text" or "json".
+	Output     string     `mapstructure:"output"`
+	Retention  Retention  `mapstructure:"retention"`
+	Encryption Encryption `mapstructure:"encryption"`
+	Redaction  Redaction  `mapstructure:"redaction"`
+	Ignore     Ignore     `mapstructure:"ignore"`
+}
+
+// Output formats.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Location is the configured time zone.
+func (c *Config) Location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone: %w", err)
+	}
+	return location, nil
+}
+
+// EnvPrefix starts the environment variables that override settings, such as
+// HISTORIAN_DATABASE or HISTORIAN_RETENTION_KEEP_LAST.
+const EnvPrefix = "HISTORIAN"
+
+// defaults lists every setting, so each can be set from the environment.
+func defaults(configDir string) map[string]interface{} {
+	return map[string]interface{}{
+		"database":               filepath.Join(configDir, "history.db"),
+		"timezone":               "",
+		"output":                 OutputText,
+		"retention.older_than":   "",
+		"retention.keep_last":    0,
+		"encryption.key_file":    "",
+		"redaction.disabled":     false,
+		"redaction.skip_builtin": false,
+		"redaction.rules":        []RedactionRule{},
+		"ignore.patterns":        []string{},
+		"ignore.space":           true,
+		"ignore.min_length":      0,
+		"ignore.max_length":      0,
+		"ignore.self":            true,
+	}
+}
+
+// loader is the state Options change.
+type loader struct {
+	v          *viper.Viper
+	file       string
+	profileDir string
+	env        bool
+}
+
+// Option changes where Load looks for settings.
+type Option func(l *loader) error
+
+// WithFile reads file instead of config.toml or config.yaml in the config directory.
+func WithFile(file string) Option {
+	return func(l *loader) error {
+		l.file = file
+		return nil
+	}
+}
+
+// WithFlag lets flag override the setting key when it is set on the command line.
+func WithFlag(key string, flag *pflag.Flag) Option {
+	return func(l *loader) error {
+		return l.v.BindPFlag(key, flag)
+	}
+}
+
+// WithProfile reads the settings of the profile kept in dir on top of the
+// config file, and keeps the database there unless the profile's own config
+// file says otherwise.
+func WithProfile(dir string) Option {
+	return func(l *loader) error {
+		l.profileDir = dir
+		return nil
+	}
+}
+
+// WithoutEnv leaves the environment out, for looking at the settings of a
+// profile other than the one in use.
+func WithoutEnv() Option {
+	return func(l *loader) error {
+		l.env = false
+		return nil
+	}
+}
+
+// Load reads config.toml (or config.yaml) from configDir, then the profile's
+// config file, the environment and the flags given with WithFlag, each
+// overriding the one before. Missing config files are not an error, they give
+// the defaults. The database of the config file in configDir is the default
+// profile's, other profiles only take it from their own config file.
+func Load(configDir string, options ...Option) (*Config, error) {
+	l := &loader{v: viper.New(), profileDir: configDir, env: true}
+	v := l.v
+	for _, option := range options {
+		if err := option(l); err != nil {
+			return nil, err
+		}
+	}
+	if l.env {
+		v.SetEnvPrefix(EnvPrefix)
+		v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+		v.AutomaticEnv()
+	}
+	for key, value := range defaults(l.profileDir) {
+		v.SetDefault(key, value)
+	}
+
+	settings, err := readConfigFile(configDir, l.file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	if l.profileDir != configDir {
+		delete(settings, "database")
+	}
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	if l.profileDir != configDir {
+		profile, err := readConfigFile(l.profileDir, "")
+		if err != nil {
+			return nil, fmt.Errorf("could not read profile config: %w", err)
+		}
+		if err := v.MergeConfigMap(profile); err != nil {
+			return nil, fmt.Errorf("could not read profile config: %w", err)
+		}
+	}
+
+	config := &Config{}
+	if err := v.Unmarshal(config); err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	switch config.Output {
+	case OutputText, OutputJSON:
+	default:
+		return nil, fmt.Errorf("unknown output %q, expected %s or %s", config.Output, OutputText, OutputJSON)
+	}
+	if _, err := config.Location(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readConfigFile returns the settings of file, or of the config file in dir
+// when file is empty. A config file missing from dir has no settings.
+func readConfigFile(dir, file string) (map[string]interface{}, error) {
+	v := viper.New()
+	if file != "" {
+		v.SetConfigFile(file)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath(dir)
+	}
+	err := v.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if errors.As(err, &notFound) {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.AllSettings(), nil
+}
+
+// ageUnits extends time.ParseDuration with days, weeks and years.
+var ageUnits = map[string]time.Duration{
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+// ParseAge parses ages like "2y", "6w", "30d" as well as anything
+// time.ParseDuration accepts.
+func ParseAge(age string) (time.Duration, error) {
+	for suffix, unit := range ageUnits {
+		if !strings.HasSuffix(age, suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSuffix(age, suffix))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", age)
+		}
+		return time.Duration(count) * unit, nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", age)
+	}
+	return duration, nil
+}
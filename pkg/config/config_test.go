@@ -0,0 +1,180 @@
+package config_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/config"
+)
+
+func TestParseAge(t *testing.T) {
+	testCases := []struct {
+		age      string
+		expected time.Duration
+	}{
+		{age: "2y", expected: 2 * 365 * 24 * time.Hour},
+		{age: "6w", expected: 6 * 7 * 24 * time.Hour},
+		{age: "30d", expected: 30 * 24 * time.Hour},
+		{age: "90m", expected: 90 * time.Minute},
+	}
+	for _, testCase := range testCases {
+		age, err := config.ParseAge(testCase.age)
+		assert.Nil(t, err)
+		assert.Equal(t, testCase.expected, age)
+	}
+	_, err := config.ParseAge("soon")
+	assert.NotNil(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	loaded, err := config.Load(dir)
+	assert.Nil(t, err)
+	assert.False(t, loaded.Retention.Enabled())
+	assert.True(t, loaded.Ignore.Space)
+	assert.True(t, loaded.Ignore.Self)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(`
+[retention]
+older_than = "2y"
+keep_last = 100
+
+[ignore]
+patterns = ["ls", "cd *"]
+space = false
+`), 0600)
+	assert.Nil(t, err)
+	loaded, err = config.Load(dir)
+	assert.Nil(t, err)
+	assert.True(t, loaded.Retention.Enabled())
+	assert.Equal(t, "2y", loaded.Retention.OlderThan)
+	assert.Equal(t, 100, loaded.Retention.KeepLast)
+	assert.Equal(t, []string{"ls", "cd *"}, loaded.Ignore.Patterns)
+	assert.False(t, loaded.Ignore.Space)
+	assert.True(t, loaded.Ignore.Self)
+}
+
+func TestLoadOverrides(t *testing.T) {
+	dir := t.TempDir()
+	loaded, err := config.Load(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "history.db"), loaded.Database)
+	assert.Equal(t, config.OutputText, loaded.Output)
+
+	file := filepath.Join(dir, "other.yaml")
+	err = ioutil.WriteFile(file, []byte(`
+database: /from/file.db
+timezone: UTC
+retention:
+  keep_last: 10
+`), 0600)
+	assert.Nil(t, err)
+
+	os.Setenv("HISTORIAN_DATABASE", "/from/env.db")
+	os.Setenv("HISTORIAN_RETENTION_KEEP_LAST", "20")
+	defer os.Unsetenv("HISTORIAN_DATABASE")
+	defer os.Unsetenv("HISTORIAN_RETENTION_KEEP_LAST")
+	flags := pflag.NewFlagSet("historian", pflag.ContinueOnError)
+	flags.String("db", "", "")
+	flags.String("output", "", "")
+
+	loaded, err = config.Load(dir, config.WithFile(file),
+		config.WithFlag("database", flags.Lookup("db")),
+		config.WithFlag("output", flags.Lookup("output")))
+	assert.Nil(t, err)
+	assert.Equal(t, "/from/env.db", loaded.Database)
+	assert.Equal(t, 20, loaded.Retention.KeepLast)
+	assert.Equal(t, "UTC", loaded.TimeZone)
+	assert.Equal(t, config.OutputText, loaded.Output, "unset flags leave the setting alone")
+
+	assert.Nil(t, flags.Parse([]string{"--db", "/from/flag.db", "--output", "json"}))
+	loaded, err = config.Load(dir, config.WithFile(file),
+		config.WithFlag("database", flags.Lookup("db")),
+		config.WithFlag("output", flags.Lookup("output")))
+	assert.Nil(t, err)
+	assert.Equal(t, "/from/flag.db", loaded.Database)
+	assert.Equal(t, config.OutputJSON, loaded.Output)
+
+	assert.Nil(t, flags.Parse([]string{"--output", "xml"}))
+	_, err = config.Load(dir, config.WithFlag("output", flags.Lookup("output")))
+	assert.NotNil(t, err)
+}
+
+func TestProfiles(t *testing.T) {
+	dir := t.TempDir()
+	current, err := config.CurrentProfile(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, config.DefaultProfile, current)
+
+	_, err = config.CreateProfile(dir, "../escape")
+	assert.NotNil(t, err)
+	work, err := config.CreateProfile(dir, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, config.ProfileDir(dir, "work"), work)
+	_, err = config.CreateProfile(dir, "demo")
+	assert.Nil(t, err)
+	profiles, err := config.Profiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{config.DefaultProfile, "demo", "work"}, profiles)
+
+	assert.True(t, errors.Is(config.UseProfile(dir, "personal"), config.ErrUnknownProfile))
+	assert.Nil(t, config.UseProfile(dir, "work"))
+	current, err = config.CurrentProfile(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "work", current)
+
+	// The profile's settings override the shared ones, and its database
+	// defaults to its own directory.
+	err = ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte("timezone = \"UTC\"\n[retention]\nkeep_last = 10\n"), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(work, "config.toml"), []byte("[retention]\nkeep_last = 20\n"), 0600)
+	assert.Nil(t, err)
+	loaded, err := config.Load(dir, config.WithProfile(work))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(work, "history.db"), loaded.Database)
+	assert.Equal(t, "UTC", loaded.TimeZone)
+	assert.Equal(t, 20, loaded.Retention.KeepLast)
+
+	assert.NotNil(t, config.DeleteProfile(dir, config.DefaultProfile))
+	assert.Nil(t, config.DeleteProfile(dir, "work"))
+	assert.False(t, config.ProfileExists(dir, "work"))
+	current, err = config.CurrentProfile(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, config.DefaultProfile, current)
+}
+
+func TestProfileDatabase(t *testing.T) {
+	dir := t.TempDir()
+	work, err := config.CreateProfile(dir, "work")
+	assert.Nil(t, err)
+	demo, err := config.CreateProfile(dir, "demo")
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte("database = \"/shared/history.db\"\ntimezone = \"UTC\"\n"), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(demo, "config.toml"), []byte("database = \"/tmp/demo.db\"\n"), 0600)
+	assert.Nil(t, err)
+
+	// The shared database is the default profile's.
+	loaded, err := config.Load(dir, config.WithProfile(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, "/shared/history.db", loaded.Database)
+	loaded, err = config.Load(dir, config.WithProfile(work))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(work, "history.db"), loaded.Database)
+	assert.Equal(t, "UTC", loaded.TimeZone)
+	loaded, err = config.Load(dir, config.WithProfile(demo))
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/demo.db", loaded.Database)
+
+	os.Setenv("HISTORIAN_DATABASE", "/from/env.db")
+	defer os.Unsetenv("HISTORIAN_DATABASE")
+	loaded, err = config.Load(dir, config.WithProfile(work), config.WithoutEnv())
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(work, "history.db"), loaded.Database)
+}
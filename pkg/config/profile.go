@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultProfile keeps its database and settings in the config directory
+// itself, where they were before there were profiles.
+const DefaultProfile = "default"
+
+// ProfileEnv selects the profile when --profile is not given.
+const ProfileEnv = EnvPrefix + "_PROFILE"
+
+// profilesDir holds a directory per profile other than the default one:
+//
+//	<config dir>/profiles/<name>/history.db
+//	<config dir>/profiles/<name>/config.toml
+const profilesDir = "profiles"
+
+// currentProfileFile names the profile chosen with UseProfile.
+const currentProfileFile = "profile"
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ErrUnknownProfile is returned for profiles that were never created.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// ValidateProfileName rejects names that are not usable as a directory name.
+func ValidateProfileName(name string) error {
+	if !profileName.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// ProfileDir is the directory of profile name.
+func ProfileDir(configDir, name string) string {
+	if name == DefaultProfile {
+		return configDir
+	}
+	return filepath.Join(configDir, profilesDir, name)
+}
+
+// Profiles lists the default profile followed by the others, sorted.
+func Profiles(configDir string) ([]string, error) {
+	profiles := []string{DefaultProfile}
+	infos, err := ioutil.ReadDir(filepath.Join(configDir, profilesDir))
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if info.IsDir() && info.Name() != DefaultProfile {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return append(profiles, names...), nil
+}
+
+// ProfileExists reports whether profile name was created.
+func ProfileExists(configDir, name string) bool {
+	if name == DefaultProfile {
+		return true
+	}
+	if ValidateProfileName(name) != nil {
+		return false
+	}
+	info, err := os.Stat(ProfileDir(configDir, name))
+	return err == nil && info.IsDir()
+}
+
+// CreateProfile makes the directory of profile name and returns it. It is
+// not an error when the profile exists.
+func CreateProfile(configDir, name string) (string, error) {
+	if err := ValidateProfileName(name); err != nil {
+		return "", err
+	}
+	dir := ProfileDir(configDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("could not create profile %s: %w", name, err)
+	}
+	return dir, nil
+}
+
+// DeleteProfile removes the directory of profile name, database included.
+// The default profile can not be deleted.
+func DeleteProfile(configDir, name string) error {
+	if name == DefaultProfile {
+		return fmt.Errorf("the %s profile can not be deleted", DefaultProfile)
+	}
+	if !ProfileExists(configDir, name) {
+		return fmt.Errorf("%w %q", ErrUnknownProfile, name)
+	}
+	if current, err := CurrentProfile(configDir); err == nil && current == name {
+		if err := UseProfile(configDir, DefaultProfile); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(ProfileDir(configDir, name))
+}
+
+// CurrentProfile is the profile chosen with UseProfile, the default profile
+// when none was chosen.
+func CurrentProfile(configDir string) (string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(configDir, currentProfileFile))
+	if os.IsNotExist(err) {
+		return DefaultProfile, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(contents))
+	if name == "" {
+		return DefaultProfile, nil
+	}
+	return name, nil
+}
+
+// UseProfile makes profile name the one used when neither --profile nor
+// $HISTORIAN_PROFILE is set.
+func UseProfile(configDir, name string) error {
+	if !ProfileExists(configDir, name) {
+		return fmt.Errorf("%w %q", ErrUnknownProfile, name)
+	}
+	file := filepath.Join(configDir, currentProfileFile)
+	if name == DefaultProfile {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(name+"\n"), 0600)
+}
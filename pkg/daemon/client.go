@@ -0,0 +1,237 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// DefaultTimeout is how long a request waits for the daemon's answer.
+const DefaultTimeout = 5 * time.Second
+
+// Client is a storage.HistoryStore backed by a running daemon.
+type Client struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	encoder *json.Encoder
+	timeout time.Duration
+}
+
+var _ storage.HistoryStore = (*Client)(nil)
+
+// Dial connects to the daemon listening on socketPath. It fails within
+// timeout when no daemon is running or the daemon does not answer, so callers
+// can fall back to opening the database.
+func Dial(socketPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		conn:    conn,
+		reader:  bufio.NewReaderSize(conn, 64*1024),
+		encoder: json.NewEncoder(conn),
+		timeout: timeout,
+	}
+	// Make sure it is a daemon that answers, not just a listening socket.
+	if err := client.call(Request{Op: OpPing}, &Response{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.timeout = DefaultTimeout
+	return client, nil
+}
+
+// SetTimeout changes how long the next requests wait for an answer, zero
+// waits for as long as it takes.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+}
+
+// IsTimeout reports whether err is a request that got no answer in time.
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsUnanswered reports whether err is a request the daemon was sent but did
+// not answer, which it may still carry out.
+func IsUnanswered(err error) bool {
+	var unanswered *unansweredError
+	return errors.As(err, &unanswered)
+}
+
+// unansweredError is the error reading the answer to a request that was sent.
+type unansweredError struct{ err error }
+
+func (e *unansweredError) Error() string { return "no answer from the daemon: " + e.err.Error() }
+
+func (e *unansweredError) Unwrap() error { return e.err }
+
+func (c *Client) call(request Request, response *Response) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := time.Time{}
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if err := c.encoder.Encode(request); err != nil {
+		return err
+	}
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		// A late answer would be taken for the next request's.
+		c.conn.Close()
+		return &unansweredError{err}
+	}
+	if err := json.Unmarshal(line, response); err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// Add to storage
+func (c *Client) Add(history *storage.History) error {
+	return c.AddDeduped(history, storage.DedupNone)
+}
+
+// AddDeduped adds history applying mode, see storage.Store.AddDeduped. With
+// storage.DedupNone the daemon applies its own dedup mode.
+func (c *Client) AddDeduped(history *storage.History, mode storage.DedupMode) error {
+	var response Response
+	if err := c.call(Request{Op: OpAdd, History: history, Dedup: mode}, &response); err != nil {
+		return err
+	}
+	if response.History != nil {
+		history.Key = response.History.Key
+	}
+	return nil
+}
+
+// Get from storage
+func (c *Client) Get(directory, key string) (*storage.History, error) {
+	var response Response
+	err := c.call(Request{Op: OpGet, Directory: directory, Key: key}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.History, nil
+}
+
+// Backup asks the daemon to write a snapshot of its database to path, which
+// must be absolute. It returns the size of the snapshot.
+func (c *Client) Backup(path string) (int64, error) {
+	var response Response
+	if err := c.call(Request{Op: OpBackup, Path: path}, &response); err != nil {
+		return 0, err
+	}
+	return response.Size, nil
+}
+
+// Import asks the daemon to import entries, see storage.Store.Import. Only
+// the cursor of options is passed on, a dry run or path rules are refused.
+func (c *Client) Import(entries []storage.History, options storage.ImportOptions) (storage.ImportReport, error) {
+	if options.DryRun || len(options.Paths) > 0 {
+		return storage.ImportReport{}, fmt.Errorf("the daemon only imports with a cursor")
+	}
+	var response Response
+	request := Request{Op: OpImport, Entries: entries, Cursor: options.Cursor, Position: options.Position}
+	if err := c.call(request, &response); err != nil {
+		return storage.ImportReport{}, err
+	}
+	if response.Import == nil {
+		return storage.ImportReport{}, nil
+	}
+	return *response.Import, nil
+}
+
+// Cursor returns how far the named cursor of the daemon's database got, see
+// storage.Store.Cursor.
+func (c *Client) Cursor(name string) (string, error) {
+	var response Response
+	if err := c.call(Request{Op: OpCursor, Cursor: name}, &response); err != nil {
+		return "", err
+	}
+	return response.Position, nil
+}
+
+// Delete an entry
+func (c *Client) Delete(directory, key string) error {
+	return c.call(Request{Op: OpDelete, Directory: directory, Key: key}, &Response{})
+}
+
+// Range over storage between dates
+func (c *Client) Range(directory string, minTime, maxTime time.Time, handler storage.HistoryHandler) error {
+	var response Response
+	err := c.call(Request{Op: OpRange, Directory: directory, Min: minTime, Max: maxTime}, &response)
+	if err != nil {
+		return err
+	}
+	for _, history := range response.Entries {
+		if err := handler(history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Last n entries. Filters cannot cross the socket, so they are applied to
+// the n entries the daemon returns, which matches what the stores do.
+func (c *Client) Last(directory string, numEntries int, filters ...storage.FilterFunction) ([]storage.History, error) {
+	var response Response
+	err := c.call(Request{Op: OpLast, Directory: directory, Count: numEntries}, &response)
+	if err != nil {
+		return nil, err
+	}
+	historyList := make([]storage.History, 0, len(response.Entries))
+	for _, history := range response.Entries {
+		keep := true
+		for _, filter := range filters {
+			keep = keep && filter([]byte(history.DirectoryName), []byte(history.Key), []byte(history.Data))
+		}
+		if keep {
+			historyList = append(historyList, history)
+		}
+	}
+	return historyList, nil
+}
+
+// Greps applies multple potential regexes to the command history
+func (c *Client) Greps(regexes ...string) ([]storage.History, error) {
+	var response Response
+	err := c.call(Request{Op: OpGreps, Regexes: regexes}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Entries, nil
+}
+
+// Usage lists how often each command ran
+func (c *Client) Usage(directory string) ([]storage.Usage, error) {
+	var response Response
+	err := c.call(Request{Op: OpUsage, Directory: directory}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Usage, nil
+}
+
+// Close the connection, the daemon keeps running.
+func (c *Client) Close() {
+	c.conn.Close()
+}
@@ -0,0 +1,207 @@
+package daemon_test
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/daemon"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	history, err := storage.NewHistory("make", storage.SetDirectory("/src"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(history))
+
+	socketPath := filepath.Join(dir, "historian.sock")
+	listener, err := daemon.Listen(socketPath)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go daemon.NewServer(store).Serve(listener)
+
+	client, err := daemon.Dial(socketPath, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	snapshot := filepath.Join(dir, "backup.db")
+	size, err := client.Backup(snapshot)
+	assert.Nil(t, err)
+	assert.True(t, size > 0)
+	_, err = storage.ValidateBackup(snapshot)
+	assert.Nil(t, err)
+}
+
+func TestAddDeduped(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	socketPath := filepath.Join(dir, "historian.sock")
+	listener, err := daemon.Listen(socketPath)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go daemon.NewServer(store).Serve(listener)
+
+	client, err := daemon.Dial(socketPath, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	for _, command := range []string{"make", "make"} {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"))
+		assert.Nil(t, err)
+		assert.Nil(t, client.AddDeduped(history, storage.DedupIgnoreDups))
+	}
+	entries, err := client.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	socketPath := filepath.Join(dir, "historian.sock")
+	listener, err := daemon.Listen(socketPath)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go daemon.NewServer(store).Serve(listener)
+
+	client, err := daemon.Dial(socketPath, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	entries := []storage.History{{Data: "make", DirectoryName: "/src", Time: time.Date(2021, 1, 31, 9, 0, 0, 0, time.UTC)}}
+	options := storage.ImportOptions{Cursor: "watch:/home/alice/.bash_history", Position: "22:abcd"}
+	for _, expected := range []storage.ImportReport{{Added: 1}, {Duplicates: 1}} {
+		report, err := client.Import(entries, options)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, report)
+	}
+	position, err := client.Cursor(options.Cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, "22:abcd", position)
+
+	_, err = client.Import(entries, storage.ImportOptions{DryRun: true})
+	assert.NotNil(t, err)
+}
+
+func TestClientServer(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "historian.sock")
+	listener, err := daemon.Listen(socketPath)
+	assert.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- daemon.NewServer(storage.NewMemoryStore()).Serve(listener)
+	}()
+
+	_, err = daemon.Listen(socketPath)
+	assert.NotNil(t, err)
+
+	client, err := daemon.Dial(socketPath, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, command := range []string{"make", "make test", "ls"} {
+		history, err := storage.NewHistory(
+			command,
+			storage.SetDirectory("/src"),
+			storage.SetTime(timestamp),
+			storage.SetExitCode(3),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, client.Add(history))
+		assert.NotEmpty(t, history.Key)
+	}
+
+	entries, err := client.Last("/src", 2)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "ls", entries[0].Data)
+	assert.Equal(t, 3, entries[0].ExitCode)
+
+	entries, err = client.Greps("make")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	entry, err := client.Get("/src", entries[0].Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "make", entry.Data)
+
+	assert.Nil(t, client.Delete("/src", entries[0].Key))
+	assert.NotNil(t, client.Delete("/src", entries[0].Key))
+
+	count := 0
+	err = client.Range("", timestamp, timestamp, func(h storage.History) error {
+		count++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = client.Greps("(")
+	assert.NotNil(t, err)
+
+	_, err = client.Backup(filepath.Join(t.TempDir(), "backup.db"))
+	assert.NotNil(t, err)
+
+	listener.Close()
+	assert.NotNil(t, <-done)
+
+	_, err = daemon.Dial(socketPath, 100*time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+// hangingDaemon answers the first request, the ping, when ping is set, and
+// never anything after it.
+func hangingDaemon(t *testing.T, socketPath string, ping bool) net.Listener {
+	listener, err := net.Listen("unix", socketPath)
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				reader := bufio.NewReader(conn)
+				if _, err := reader.ReadBytes('\n'); err != nil || !ping {
+					return
+				}
+				conn.Write([]byte("{}\n"))
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestHungDaemonTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	silent := hangingDaemon(t, filepath.Join(dir, "silent.sock"), false)
+	defer silent.Close()
+	started := time.Now()
+	_, err := daemon.Dial(filepath.Join(dir, "silent.sock"), 50*time.Millisecond)
+	assert.True(t, daemon.IsTimeout(err))
+	assert.True(t, time.Since(started) < time.Second)
+
+	hung := hangingDaemon(t, filepath.Join(dir, "hung.sock"), true)
+	defer hung.Close()
+	client, err := daemon.Dial(filepath.Join(dir, "hung.sock"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	defer client.Close()
+	client.SetTimeout(50 * time.Millisecond)
+	history, err := storage.NewHistory("make", storage.SetDirectory("/src"))
+	assert.Nil(t, err)
+	started = time.Now()
+	err = client.Add(history)
+	assert.True(t, daemon.IsTimeout(err))
+	assert.True(t, daemon.IsUnanswered(err))
+	assert.True(t, time.Since(started) < time.Second)
+}
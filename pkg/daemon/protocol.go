@@ -0,0 +1,59 @@
+// Package daemon serves a storage.HistoryStore over a Unix socket, so a single
+// long running process can own the database while every shell talks to it.
+//
+// The protocol is newline delimited JSON: each request line is answered by
+// exactly one response line, in order.
+package daemon
+
+import (
+	"time"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// Operations understood by the daemon.
+const (
+	OpAdd    = "add"
+	OpGet    = "get"
+	OpDelete = "delete"
+	OpRange  = "range"
+	OpLast   = "last"
+	OpGreps  = "greps"
+	OpUsage  = "usage"
+	OpBackup = "backup"
+	OpImport = "import"
+	OpCursor = "cursor"
+	OpPing   = "ping"
+)
+
+// Request is one line sent by a client.
+type Request struct {
+	Op        string           `json:"op"`
+	Directory string           `json:"dir,omitempty"`
+	Key       string           `json:"key,omitempty"`
+	Min       time.Time        `json:"min,omitempty"`
+	Max       time.Time        `json:"max,omitempty"`
+	Count     int              `json:"count,omitempty"`
+	Regexes   []string         `json:"regexes,omitempty"`
+	Path      string           `json:"path,omitempty"`
+	History   *storage.History `json:"history,omitempty"`
+	// Dedup, when set, is applied to an added entry instead of the daemon's
+	// dedup mode.
+	Dedup storage.DedupMode `json:"dedup,omitempty"`
+	// Entries are imported, moving Cursor to Position along with them.
+	Entries  []storage.History `json:"entries,omitempty"`
+	Cursor   string            `json:"cursor,omitempty"`
+	Position string            `json:"position,omitempty"`
+}
+
+// Response is the line the daemon answers a request with.
+type Response struct {
+	Error   string                `json:"error,omitempty"`
+	History *storage.History      `json:"history,omitempty"`
+	Entries []storage.History     `json:"entries,omitempty"`
+	Usage   []storage.Usage       `json:"usage,omitempty"`
+	Size    int64                 `json:"size,omitempty"`
+	Import  *storage.ImportReport `json:"import,omitempty"`
+	// Position is how far the cursor asked for got.
+	Position string `json:"position,omitempty"`
+}
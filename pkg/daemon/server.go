@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// maxRequestSize bounds a single request line, heredocs can be long.
+const maxRequestSize = 16 * 1024 * 1024
+
+// Server answers requests against a store.
+type Server struct {
+	store storage.HistoryStore
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewServer returns a server for store. The store is not closed by the server.
+func NewServer(store storage.HistoryStore) *Server {
+	return &Server{
+		store: store,
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+// Listen on socketPath, replacing a socket file left behind by a daemon that
+// is no longer running.
+func Listen(socketPath string) (net.Listener, error) {
+	if client, err := Dial(socketPath, time.Second); err == nil {
+		client.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve accepts connections until the listener is closed. It then disconnects
+// idle clients and waits for requests that are being answered to finish, so
+// the store can be closed safely once it returns.
+func (s *Server) Serve(listener net.Listener) error {
+	defer s.wg.Wait()
+	defer s.closeConnections()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) closeConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxRequestSize)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var request Request
+		var response Response
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response.Error = fmt.Sprintf("malformed request: %v", err)
+		} else {
+			response = s.dispatch(request)
+		}
+		if err := encoder.Encode(response); err != nil {
+			logrus.Debugf("could not answer client: %v", err)
+			return
+		}
+	}
+}
+
+// backuper is implemented by stores that can snapshot themselves to a file.
+type backuper interface {
+	Backup(path string) (int64, error)
+}
+
+// importer is implemented by stores that can import entries with a cursor.
+type importer interface {
+	Import(entries []storage.History, options storage.ImportOptions) (storage.ImportReport, error)
+	Cursor(name string) (string, error)
+}
+
+// deduper is implemented by stores that can apply a dedup mode per entry.
+type deduper interface {
+	AddDeduped(history *storage.History, mode storage.DedupMode) error
+}
+
+func (s *Server) dispatch(request Request) Response {
+	var response Response
+	var err error
+	switch request.Op {
+	case OpPing:
+	case OpAdd:
+		if request.History == nil {
+			err = fmt.Errorf("add needs a history entry")
+			break
+		}
+		if request.Dedup == storage.DedupNone {
+			err = s.store.Add(request.History)
+		} else if d, ok := s.store.(deduper); ok {
+			err = d.AddDeduped(request.History, request.Dedup)
+		} else {
+			err = fmt.Errorf("this store can not dedup entries")
+		}
+		response.History = request.History
+	case OpGet:
+		response.History, err = s.store.Get(request.Directory, request.Key)
+	case OpDelete:
+		err = s.store.Delete(request.Directory, request.Key)
+	case OpRange:
+		response.Entries = []storage.History{}
+		err = s.store.Range(request.Directory, request.Min, request.Max, func(h storage.History) error {
+			response.Entries = append(response.Entries, h)
+			return nil
+		})
+	case OpLast:
+		response.Entries, err = s.store.Last(request.Directory, request.Count)
+	case OpGreps:
+		response.Entries, err = s.store.Greps(request.Regexes...)
+	case OpUsage:
+		response.Usage, err = s.store.Usage(request.Directory)
+	case OpBackup:
+		b, ok := s.store.(backuper)
+		if !ok {
+			err = fmt.Errorf("this store can not be backed up")
+			break
+		}
+		response.Size, err = b.Backup(request.Path)
+	case OpImport, OpCursor:
+		i, ok := s.store.(importer)
+		if !ok {
+			err = fmt.Errorf("this store can not import entries")
+			break
+		}
+		if request.Op == OpCursor {
+			response.Position, err = i.Cursor(request.Cursor)
+			break
+		}
+		var report storage.ImportReport
+		report, err = i.Import(request.Entries, storage.ImportOptions{Cursor: request.Cursor, Position: request.Position})
+		response.Import = &report
+	default:
+		err = fmt.Errorf("unknown operation %q", request.Op)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
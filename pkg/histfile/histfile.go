@@ -0,0 +1,92 @@
+// Package histfile reads and writes history in formats other tools use, the
+// history files of bash, zsh and fish, and json and csv for everything else.
+package histfile
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// Format is a history file format.
+type Format string
+
+const (
+	// JSON is an array of entries, JSONL an entry per line.
+	JSON  Format = "json"
+	JSONL Format = "jsonl"
+	// CSV has a header row naming the columns.
+	CSV Format = "csv"
+	// Bash is a bash history file with a #<epoch> line before every command,
+	// as written with HISTTIMEFORMAT set.
+	Bash Format = "bash"
+	// Zsh is a zsh history file in the EXTENDED_HISTORY format,
+	// ": <epoch>:<duration>;<command>".
+	Zsh Format = "zsh"
+	// Fish is fish's YAML like history file.
+	Fish Format = "fish"
+	// HistoryOutput is the output of bash's history builtin, such as the
+	// lines "history 1" appends to a file after every command.
+	HistoryOutput Format = "history-output"
+)
+
+var (
+	// ExportFormats can be written with NewWriter.
+	ExportFormats = []Format{JSON, JSONL, CSV, Bash, Zsh, Fish}
+	// ImportFormats can be read with NewReader.
+	ImportFormats = []Format{Bash, Zsh, Fish, HistoryOutput}
+)
+
+// ParseFormat returns the format called name, one of formats.
+func ParseFormat(name string, formats []Format) (Format, error) {
+	for _, format := range formats {
+		if string(format) == name {
+			return format, nil
+		}
+	}
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		names[i] = string(format)
+	}
+	return "", fmt.Errorf("unknown format %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Entry is how an entry is written as json.
+type Entry struct {
+	Key        string     `json:"key"`
+	Command    string     `json:"cmd"`
+	Directory  string     `json:"dir"`
+	Annotation string     `json:"annotation,omitempty"`
+	Start      time.Time  `json:"start"`
+	End        *time.Time `json:"end,omitempty"`
+	ExitCode   int        `json:"exit"`
+	SessionID  string     `json:"session,omitempty"`
+	Hostname   string     `json:"host,omitempty"`
+	Username   string     `json:"user,omitempty"`
+	Shell      string     `json:"shell,omitempty"`
+	TTY        string     `json:"tty,omitempty"`
+}
+
+// NewEntry returns history as written as json.
+func NewEntry(history storage.History) Entry {
+	entry := Entry{
+		Key:        history.Key,
+		Command:    history.Data,
+		Directory:  history.DirectoryName,
+		Annotation: history.Annotation,
+		Start:      history.Time,
+		ExitCode:   history.ExitCode,
+		SessionID:  history.SessionID,
+		Hostname:   history.Hostname,
+		Username:   history.Username,
+		Shell:      history.Shell,
+		TTY:        history.TTY,
+	}
+	if !history.EndTime.IsZero() {
+		end := history.EndTime
+		entry.End = &end
+	}
+	return entry
+}
@@ -0,0 +1,264 @@
+package histfile_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/histfile"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+func testEntries() []storage.History {
+	start := time.Date(2021, 1, 31, 9, 0, 0, 0, time.UTC)
+	return []storage.History{
+		{
+			Key:           string(storage.MakeKey(start, 1)),
+			Data:          "make test",
+			Time:          start,
+			EndTime:       start.Add(90 * time.Second),
+			DirectoryName: "/home/alice/code",
+			Annotation:    "runs the slow tests too",
+			ExitCode:      2,
+			Hostname:      "laptop",
+		},
+		{
+			Key:           string(storage.MakeKey(start.Add(time.Minute), 2)),
+			Data:          "for f in *; do\n  echo \"$f\" \\ done\ndone",
+			Time:          start.Add(time.Minute),
+			DirectoryName: "/tmp",
+		},
+	}
+}
+
+func write(t *testing.T, format histfile.Format, entries []storage.History) string {
+	var out bytes.Buffer
+	writer, err := histfile.NewWriter(&out, format)
+	assert.Nil(t, err)
+	for _, history := range entries {
+		assert.Nil(t, writer.Write(history))
+	}
+	assert.Nil(t, writer.Close())
+	return out.String()
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := histfile.ParseFormat("zsh", histfile.ExportFormats)
+	assert.Nil(t, err)
+	assert.Equal(t, histfile.Zsh, format)
+	_, err = histfile.ParseFormat("tcsh", histfile.ExportFormats)
+	assert.NotNil(t, err)
+}
+
+func TestWriteShells(t *testing.T) {
+	entries := testEntries()
+	testCases := []struct {
+		format   histfile.Format
+		expected string
+	}{
+		{
+			format: histfile.Bash,
+			expected: "#1612083600\nmake test\n" +
+				"#1612083660\nfor f in *; do\n  echo \"$f\" \\ done\ndone\n",
+		},
+		{
+			format: histfile.Zsh,
+			expected: ": 1612083600:90;make test\n" +
+				": 1612083660:0;for f in *; do\\\n  echo \"$f\" \\ done\\\ndone\n",
+		},
+		{
+			format: histfile.Fish,
+			expected: "- cmd: make test\n  when: 1612083600\n" +
+				"- cmd: for f in *; do\\n  echo \"$f\" \\\\ done\\ndone\n  when: 1612083660\n",
+		},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, write(t, testCase.format, entries), string(testCase.format))
+	}
+}
+
+func TestWriteZshMetafies(t *testing.T) {
+	entry := storage.History{Data: "echo —", Time: time.Unix(1612083600, 0)}
+	// The dash is e2 80 94, zsh writes 94 as 83 b4.
+	assert.Equal(t, ": 1612083600:0;echo \xe2\x80\x83\xb4\n", write(t, histfile.Zsh, []storage.History{entry}))
+}
+
+func TestWriteJSON(t *testing.T) {
+	entries := testEntries()
+	var decoded []histfile.Entry
+	assert.Nil(t, json.Unmarshal([]byte(write(t, histfile.JSON, entries)), &decoded))
+	assert.Equal(t, 2, len(decoded))
+	assert.Equal(t, "make test", decoded[0].Command)
+	assert.Equal(t, "runs the slow tests too", decoded[0].Annotation)
+	assert.Equal(t, 2, decoded[0].ExitCode)
+	assert.Equal(t, "laptop", decoded[0].Hostname)
+	assert.Equal(t, entries[0].EndTime, *decoded[0].End)
+	assert.Nil(t, decoded[1].End)
+	assert.Equal(t, entries[1].Data, decoded[1].Command)
+
+	assert.Equal(t, "[]\n", write(t, histfile.JSON, nil))
+
+	lines := bytes.Split(bytes.TrimSpace([]byte(write(t, histfile.JSONL, entries))), []byte("\n"))
+	assert.Equal(t, 2, len(lines))
+	var entry histfile.Entry
+	assert.Nil(t, json.Unmarshal(lines[1], &entry))
+	assert.Equal(t, "/tmp", entry.Directory)
+}
+
+func TestWriteCSV(t *testing.T) {
+	entries := testEntries()
+	records, err := csv.NewReader(bytes.NewBufferString(write(t, histfile.CSV, entries))).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, "start", records[0][0])
+	assert.Equal(t, []string{
+		"2021-01-31T09:00:00Z", "2021-01-31T09:01:30Z", "/home/alice/code", "make test", "2",
+		"runs the slow tests too", "", "laptop", "", "", "", entries[0].Key,
+	}, records[1])
+	assert.Equal(t, entries[1].Data, records[2][3])
+	assert.Equal(t, "", records[2][1])
+
+	records, err = csv.NewReader(bytes.NewBufferString(write(t, histfile.CSV, nil))).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+}
+
+func read(t *testing.T, format histfile.Format, contents string) []storage.History {
+	reader, err := histfile.NewReader(bytes.NewBufferString(contents), format)
+	assert.Nil(t, err)
+	entries, err := reader.ReadAll()
+	assert.Nil(t, err)
+	return entries
+}
+
+func TestReadBash(t *testing.T) {
+	entries := read(t, histfile.Bash, "ls\ncd /tmp\n\n#1612083600\nmake test\n#1612083660\nfor f in *; do\n  echo \"$f\"\ndone\n#1612083700\n")
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "ls", entries[0].Data)
+	assert.True(t, entries[0].Time.IsZero())
+	assert.Equal(t, "cd /tmp", entries[1].Data)
+	assert.Equal(t, "make test", entries[2].Data)
+	assert.Equal(t, int64(1612083600), entries[2].Time.Unix())
+	assert.Equal(t, "bash", entries[2].Shell)
+	assert.Equal(t, "for f in *; do\n  echo \"$f\"\ndone", entries[3].Data)
+}
+
+func TestReadZsh(t *testing.T) {
+	entries := read(t, histfile.Zsh, ": 1612083600:90;make test\n: 1612083660:0;for f in *; do\\\n  echo \"$f\"\\\ndone\nls -la\n")
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "make test", entries[0].Data)
+	assert.Equal(t, int64(1612083600), entries[0].Time.Unix())
+	assert.Equal(t, 90*time.Second, entries[0].Duration())
+	assert.Equal(t, "for f in *; do\n  echo \"$f\"\ndone", entries[1].Data)
+	assert.Equal(t, "ls -la", entries[2].Data)
+	assert.True(t, entries[2].Time.IsZero())
+
+	entries = read(t, histfile.Zsh, ": 1612083600:0;echo \xe2\x80\x83\xb4\n")
+	assert.Equal(t, "echo —", entries[0].Data)
+}
+
+func TestReadFish(t *testing.T) {
+	entries := read(t, histfile.Fish, "- cmd: make test\n  when: 1612083600\n  paths:\n    - test\n- cmd: echo a\\\\b\\nc\n  when: 1612083660\n")
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "make test", entries[0].Data)
+	assert.Equal(t, int64(1612083600), entries[0].Time.Unix())
+	assert.Equal(t, "echo a\\b\nc", entries[1].Data)
+	assert.Equal(t, "fish", entries[1].Shell)
+}
+
+func TestReadHistoryOutput(t *testing.T) {
+	entries := read(t, histfile.HistoryOutput, "  501  ls -la\n  502* git commit -m 'first\nsecond'\n10003  2021-01-31 09:00:00 make test\n")
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, int64(501), entries[0].ID)
+	assert.Equal(t, "ls -la", entries[0].Data)
+	assert.Equal(t, "git commit -m 'first\nsecond'", entries[1].Data)
+	assert.Equal(t, "make test", entries[2].Data)
+	assert.Equal(t, time.Date(2021, 1, 31, 9, 0, 0, 0, time.Local), entries[2].Time)
+
+	reader, err := histfile.NewReader(bytes.NewBufferString("ls\n"), histfile.HistoryOutput)
+	assert.Nil(t, err)
+	_, err = reader.ReadAll()
+	assert.NotNil(t, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	entries := testEntries()
+	for _, format := range []histfile.Format{histfile.Bash, histfile.Zsh, histfile.Fish} {
+		read := read(t, format, write(t, format, entries))
+		assert.Equal(t, len(entries), len(read), string(format))
+		for i := range entries {
+			assert.Equal(t, entries[i].Data, read[i].Data, string(format))
+			assert.Equal(t, entries[i].Time.Unix(), read[i].Time.Unix(), string(format))
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	undated := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	dated := time.Date(2021, 1, 31, 9, 0, 0, 0, time.UTC)
+	entries := []storage.History{{Data: "a"}, {Data: "b"}, {Data: "c", Time: dated}, {Data: "d"}}
+	histfile.Date(entries, undated)
+	assert.Equal(t, dated.Add(-2*time.Nanosecond), entries[0].Time)
+	assert.Equal(t, dated.Add(-time.Nanosecond), entries[1].Time)
+	assert.Equal(t, dated, entries[2].Time)
+	assert.Equal(t, dated.Add(time.Nanosecond), entries[3].Time)
+
+	entries = []storage.History{{Data: "a"}, {Data: "b"}}
+	histfile.Date(entries, undated)
+	assert.Equal(t, undated, entries[0].Time)
+	assert.Equal(t, undated.Add(time.Nanosecond), entries[1].Time)
+}
+
+func TestReadFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".bash_history")
+	appendTo := func(contents string) {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		assert.Nil(t, err)
+		_, err = file.WriteString(contents)
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+	}
+	appendTo("#1612083600\nmake test\n#1612083660\n")
+
+	entries, position, reset, err := histfile.ReadFrom(path, histfile.Bash, histfile.Position{})
+	assert.Nil(t, err)
+	assert.False(t, reset)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "make test", entries[0].Data)
+	// The last timestamp waits for its command.
+	assert.Equal(t, int64(len("#1612083600\nmake test\n")), position.Offset)
+
+	parsed, err := histfile.ParsePosition(position.String())
+	assert.Nil(t, err)
+	assert.Equal(t, position, parsed)
+
+	appendTo("git push\n#1612083700\nls")
+	entries, position, reset, err = histfile.ReadFrom(path, histfile.Bash, position)
+	assert.Nil(t, err)
+	assert.False(t, reset)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "git push", entries[0].Data)
+	assert.Equal(t, int64(1612083660), entries[0].Time.Unix())
+
+	entries, same, _, err := histfile.ReadFrom(path, histfile.Bash, position)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	assert.Equal(t, position, same)
+
+	// Cut down to the last entries, as bash does for HISTFILESIZE.
+	assert.Nil(t, ioutil.WriteFile(path, []byte("#1612083660\ngit push\n#1612083700\nls\n"), 0600))
+	entries, _, reset, err = histfile.ReadFrom(path, histfile.Bash, position)
+	assert.Nil(t, err)
+	assert.True(t, reset)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "ls", entries[1].Data)
+
+	_, err = histfile.ParsePosition("nope")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,317 @@
+package histfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// Reader reads the entries of a history file, oldest first. Shell history
+// files record the command and at most when it ran, the other fields are left
+// empty. Entries without a time, such as those of a bash history file written
+// without HISTTIMEFORMAT, have a zero Time, see Date.
+type Reader struct {
+	format  Format
+	scanner *bufio.Scanner
+	line    int
+	// peeked is a line read ahead, to find where a multi-line entry ends.
+	peeked *string
+	// dated is true once a bash history file had a #<epoch> line.
+	dated bool
+}
+
+// NewReader returns a reader of format from r.
+func NewReader(r io.Reader, format Format) (*Reader, error) {
+	for _, readable := range ImportFormats {
+		if format == readable {
+			scanner := bufio.NewScanner(r)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			return &Reader{format: format, scanner: scanner}, nil
+		}
+	}
+	return nil, fmt.Errorf("can not read format %q", format)
+}
+
+// Read returns the next entry, or io.EOF after the last one.
+func (r *Reader) Read() (storage.History, error) {
+	for {
+		var history storage.History
+		var ok bool
+		var err error
+		switch r.format {
+		case Bash:
+			history, ok, err = r.readBash()
+		case Zsh:
+			history, ok, err = r.readZsh()
+		case Fish:
+			history, ok, err = r.readFish()
+		case HistoryOutput:
+			history, ok, err = r.readHistoryOutput()
+		}
+		if err != nil || ok {
+			return history, err
+		}
+	}
+}
+
+// ReadAll returns every entry left.
+func (r *Reader) ReadAll() ([]storage.History, error) {
+	entries := []storage.History{}
+	for {
+		history, err := r.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, history)
+	}
+}
+
+// next returns the next line, without its line ending, or io.EOF.
+func (r *Reader) next() (string, error) {
+	if r.peeked != nil {
+		line := *r.peeked
+		r.peeked = nil
+		return line, nil
+	}
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	r.line++
+	return strings.TrimSuffix(r.scanner.Text(), "\r"), nil
+}
+
+// unread puts line back, to be returned by next again.
+func (r *Reader) unread(line string) {
+	r.peeked = &line
+}
+
+func (r *Reader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", r.line, fmt.Sprintf(format, args...))
+}
+
+var bashTimestamp = regexp.MustCompile(`^#([0-9]+)$`)
+
+// readBash reads a bash history file. Once the file has #<epoch> lines, the
+// lines up to the next one are a single multi-line command, like bash reads
+// them with lithist set. Lines before the first one are commands of their own.
+// The bool is false for lines that are not an entry, such as blank lines.
+func (r *Reader) readBash() (storage.History, bool, error) {
+	line, err := r.next()
+	if err != nil {
+		return storage.History{}, false, err
+	}
+	history := storage.History{Shell: string(Bash)}
+	if match := bashTimestamp.FindStringSubmatch(line); match != nil {
+		r.dated = true
+		epoch, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return history, false, r.errorf("invalid timestamp %q", line)
+		}
+		history.Time = time.Unix(epoch, 0)
+		if line, err = r.next(); err == io.EOF {
+			return history, false, nil
+		} else if err != nil {
+			return history, false, err
+		}
+		if bashTimestamp.MatchString(line) {
+			r.unread(line)
+			return history, false, nil
+		}
+	}
+	lines := []string{line}
+	for r.dated {
+		following, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return history, false, err
+		}
+		if bashTimestamp.MatchString(following) {
+			r.unread(following)
+			break
+		}
+		lines = append(lines, following)
+	}
+	history.Data = strings.TrimRight(strings.Join(lines, "\n"), "\n")
+	return history, strings.TrimSpace(history.Data) != "", nil
+}
+
+var zshExtended = regexp.MustCompile(`^: *([0-9]+):([0-9]+);(.*)$`)
+
+// readZsh reads a zsh history file, with or without EXTENDED_HISTORY. Lines of
+// a multi-line command end in a backslash.
+func (r *Reader) readZsh() (storage.History, bool, error) {
+	line, err := r.next()
+	if err != nil {
+		return storage.History{}, false, err
+	}
+	line = unmetafy(line)
+	history := storage.History{Shell: string(Zsh)}
+	if match := zshExtended.FindStringSubmatch(line); match != nil {
+		epoch, _ := strconv.ParseInt(match[1], 10, 64)
+		duration, _ := strconv.ParseInt(match[2], 10, 64)
+		history.Time = time.Unix(epoch, 0)
+		history.EndTime = history.Time.Add(time.Duration(duration) * time.Second)
+		line = match[3]
+	}
+	lines := []string{}
+	for strings.HasSuffix(line, `\`) {
+		lines = append(lines, strings.TrimSuffix(line, `\`))
+		following, err := r.next()
+		if err == io.EOF {
+			line = ""
+			break
+		}
+		if err != nil {
+			return history, false, err
+		}
+		line = unmetafy(following)
+	}
+	history.Data = strings.TrimRight(strings.Join(append(lines, line), "\n"), "\n")
+	return history, strings.TrimSpace(history.Data) != "", nil
+}
+
+// unmetafy undoes metafy.
+func unmetafy(s string) string {
+	if strings.IndexByte(s, zshMeta) < 0 {
+		return s
+	}
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == zshMeta && i+1 < len(s) {
+			i++
+			builder.WriteByte(s[i] ^ zshMetaMask)
+			continue
+		}
+		builder.WriteByte(s[i])
+	}
+	return builder.String()
+}
+
+// fishUnescaper undoes fishEscaper.
+var fishUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+// readFish reads a fish history file, an entry is a "- cmd:" line followed by
+// indented fields, of which only "when:" is kept.
+func (r *Reader) readFish() (storage.History, bool, error) {
+	line, err := r.next()
+	if err != nil {
+		return storage.History{}, false, err
+	}
+	if !strings.HasPrefix(line, "- cmd:") {
+		// Fields of an entry were read already, or this is not an entry.
+		return storage.History{}, false, nil
+	}
+	history := storage.History{
+		Shell: string(Fish),
+		Data:  fishUnescaper.Replace(strings.TrimPrefix(strings.TrimPrefix(line, "- cmd:"), " ")),
+	}
+	for {
+		field, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return history, false, err
+		}
+		if !strings.HasPrefix(field, " ") {
+			r.unread(field)
+			break
+		}
+		if when := strings.TrimSpace(field); strings.HasPrefix(when, "when:") {
+			epoch, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(when, "when:")), 10, 64)
+			if err != nil {
+				return history, false, r.errorf("invalid timestamp %q", field)
+			}
+			history.Time = time.Unix(epoch, 0)
+		}
+	}
+	return history, strings.TrimSpace(history.Data) != "", nil
+}
+
+var (
+	// historyOutputLine is a line of bash's history builtin output, which
+	// marks entries edited since they were read with a *.
+	historyOutputLine = regexp.MustCompile(`^ *([0-9]+)\*? {1,2}(.*)$`)
+	// historyOutputTime is the time HISTTIMEFORMAT="%F %T " adds.
+	historyOutputTime = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}) (.*)$`)
+)
+
+// readHistoryOutput reads what the history builtin prints, as appended to a
+// file by "history 1" after every command. Lines that do not start with an
+// entry number continue the command before them. Times are only read when
+// HISTTIMEFORMAT was "%F %T ", in the local time zone.
+func (r *Reader) readHistoryOutput() (storage.History, bool, error) {
+	line, err := r.next()
+	if err != nil {
+		return storage.History{}, false, err
+	}
+	match := historyOutputLine.FindStringSubmatch(line)
+	if match == nil {
+		if strings.TrimSpace(line) == "" {
+			return storage.History{}, false, nil
+		}
+		return storage.History{}, false, r.errorf("expected an entry number, found %q", line)
+	}
+	history := storage.History{Shell: string(Bash)}
+	history.ID, _ = strconv.ParseInt(match[1], 10, 64)
+	command := match[2]
+	if timed := historyOutputTime.FindStringSubmatch(command); timed != nil {
+		if timestamp, err := time.ParseInLocation("2006-01-02 15:04:05", timed[1], time.Local); err == nil {
+			history.Time = timestamp
+			command = timed[2]
+		}
+	}
+	lines := []string{command}
+	for {
+		following, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return history, false, err
+		}
+		if historyOutputLine.MatchString(following) {
+			r.unread(following)
+			break
+		}
+		lines = append(lines, following)
+	}
+	history.Data = strings.TrimRight(strings.Join(lines, "\n"), "\n")
+	return history, strings.TrimSpace(history.Data) != "", nil
+}
+
+// Date gives the entries without a time one, keeping their order: a
+// nanosecond after the entry before them. Entries before the first entry with
+// a time end a nanosecond before it, and when no entry has a time they are
+// dated from undated on. Entries dated the same way again can be found as
+// duplicates when the file is imported again, as long as lines were only
+// appended to it.
+func Date(entries []storage.History, undated time.Time) {
+	previous := undated.Add(-time.Nanosecond)
+	for i := range entries {
+		if !entries[i].Time.IsZero() {
+			previous = entries[i].Time.Add(-time.Duration(i+1) * time.Nanosecond)
+			break
+		}
+	}
+	for i := range entries {
+		if entries[i].Time.IsZero() {
+			entries[i].Time = previous.Add(time.Nanosecond)
+		}
+		previous = entries[i].Time
+	}
+}
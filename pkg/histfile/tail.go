@@ -0,0 +1,136 @@
+package histfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// fingerprintSize is how many bytes before its offset a Position checks.
+const fingerprintSize = 64
+
+// Position is how far a growing history file was read: the offset and a hash
+// of the bytes right before it, which tells when the file was truncated or
+// replaced since.
+type Position struct {
+	Offset      int64
+	Fingerprint string
+}
+
+// ParsePosition reads a position written with String, an empty string is the
+// start of the file.
+func ParsePosition(position string) (Position, error) {
+	if position == "" {
+		return Position{}, nil
+	}
+	parts := strings.SplitN(position, ":", 2)
+	offset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 || offset < 0 {
+		return Position{}, fmt.Errorf("invalid history file position %q", position)
+	}
+	return Position{Offset: offset, Fingerprint: parts[1]}, nil
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%s", p.Offset, p.Fingerprint)
+}
+
+// ReadFrom returns the entries appended to the history file at path since
+// position, and the position after them. When the file was truncated or
+// replaced since, such as when bash cut it down to HISTFILESIZE lines or it
+// was rotated, it is read from the start again and reset is true. Only whole
+// lines are read, and a #<epoch> line or zsh continuation at the end is left
+// for the next call, so an entry that is still being written is read whole.
+func ReadFrom(path string, format Format, position Position) (entries []storage.History, next Position, reset bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, position, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, position, false, err
+	}
+	size := info.Size()
+	if position.Offset > 0 {
+		same := position.Offset <= size
+		if same {
+			fingerprint, err := fingerprintAt(file, position.Offset)
+			if err != nil {
+				return nil, position, false, err
+			}
+			same = fingerprint == position.Fingerprint
+		}
+		if !same {
+			position, reset = Position{}, true
+		}
+	}
+	if size == position.Offset {
+		return nil, position, reset, nil
+	}
+
+	chunk := make([]byte, size-position.Offset)
+	read, err := file.ReadAt(chunk, position.Offset)
+	if err != nil && err != io.EOF {
+		return nil, position, reset, err
+	}
+	end := completeLength(chunk[:read], format)
+	if end == 0 {
+		return nil, position, reset, nil
+	}
+	reader, err := NewReader(bytes.NewReader(chunk[:end]), format)
+	if err != nil {
+		return nil, position, reset, err
+	}
+	entries, err = reader.ReadAll()
+	if err != nil {
+		return nil, position, reset, err
+	}
+	next = Position{Offset: position.Offset + int64(end)}
+	if next.Fingerprint, err = fingerprintAt(file, next.Offset); err != nil {
+		return nil, position, reset, err
+	}
+	return entries, next, reset, nil
+}
+
+// fingerprintAt hashes the bytes of file right before offset.
+func fingerprintAt(file *os.File, offset int64) (string, error) {
+	start := offset - fingerprintSize
+	if start < 0 {
+		start = 0
+	}
+	contents := make([]byte, offset-start)
+	if _, err := file.ReadAt(contents, start); err != nil && err != io.EOF {
+		return "", err
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// completeLength is how much of chunk holds whole entries of format.
+func completeLength(chunk []byte, format Format) int {
+	end := bytes.LastIndexByte(chunk, '\n') + 1
+	for end > 0 {
+		start := bytes.LastIndexByte(chunk[:end-1], '\n') + 1
+		last := strings.TrimSuffix(string(chunk[start:end-1]), "\r")
+		waiting := false
+		switch format {
+		case Bash:
+			waiting = bashTimestamp.MatchString(last)
+		case Zsh:
+			waiting = strings.HasSuffix(last, `\`)
+		}
+		if !waiting {
+			break
+		}
+		end = start
+	}
+	return end
+}
@@ -0,0 +1,202 @@
+package histfile
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// Writer writes entries to a history file. Close finishes the file, it does
+// not close the underlying writer.
+type Writer interface {
+	Write(history storage.History) error
+	Close() error
+}
+
+// NewWriter returns a writer of format to w. The shell formats only keep the
+// command and its times, json and csv keep the annotation and everything
+// recorded with the command.
+func NewWriter(w io.Writer, format Format) (Writer, error) {
+	buffered := bufio.NewWriter(w)
+	switch format {
+	case JSON:
+		return &jsonWriter{w: buffered}, nil
+	case JSONL:
+		return &jsonlWriter{w: buffered, encoder: json.NewEncoder(buffered)}, nil
+	case CSV:
+		return &csvWriter{w: csv.NewWriter(buffered), buffered: buffered}, nil
+	case Bash:
+		return &lineWriter{w: buffered, format: bashLine}, nil
+	case Zsh:
+		return &lineWriter{w: buffered, format: zshLine}, nil
+	case Fish:
+		return &lineWriter{w: buffered, format: fishLine}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type jsonWriter struct {
+	w       *bufio.Writer
+	written int
+}
+
+func (j *jsonWriter) Write(history storage.History) error {
+	encoded, err := json.MarshalIndent(NewEntry(history), "  ", "  ")
+	if err != nil {
+		return err
+	}
+	separator := "[\n  "
+	if j.written > 0 {
+		separator = ",\n  "
+	}
+	j.written++
+	if _, err := j.w.WriteString(separator); err != nil {
+		return err
+	}
+	_, err = j.w.Write(encoded)
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	end := "\n]\n"
+	if j.written == 0 {
+		end = "[]\n"
+	}
+	if _, err := j.w.WriteString(end); err != nil {
+		return err
+	}
+	return j.w.Flush()
+}
+
+type jsonlWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (j *jsonlWriter) Write(history storage.History) error {
+	return j.encoder.Encode(NewEntry(history))
+}
+
+func (j *jsonlWriter) Close() error {
+	return j.w.Flush()
+}
+
+// csvHeader names the columns written by csvWriter.
+var csvHeader = []string{"start", "end", "dir", "cmd", "exit", "annotation", "session", "host", "user", "shell", "tty", "key"}
+
+type csvWriter struct {
+	w        *csv.Writer
+	buffered *bufio.Writer
+	started  bool
+}
+
+func (c *csvWriter) Write(history storage.History) error {
+	if !c.started {
+		c.started = true
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	end := ""
+	if !history.EndTime.IsZero() {
+		end = history.EndTime.Format(time.RFC3339Nano)
+	}
+	return c.w.Write([]string{
+		history.Time.Format(time.RFC3339Nano),
+		end,
+		history.DirectoryName,
+		history.Data,
+		strconv.Itoa(history.ExitCode),
+		history.Annotation,
+		history.SessionID,
+		history.Hostname,
+		history.Username,
+		history.Shell,
+		history.TTY,
+		history.Key,
+	})
+}
+
+func (c *csvWriter) Close() error {
+	if !c.started {
+		c.started = true
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+	return c.buffered.Flush()
+}
+
+// lineWriter writes the shell formats, where every entry is formatted on its own.
+type lineWriter struct {
+	w      *bufio.Writer
+	format func(history storage.History) string
+}
+
+func (l *lineWriter) Write(history storage.History) error {
+	_, err := l.w.WriteString(l.format(history))
+	return err
+}
+
+func (l *lineWriter) Close() error {
+	return l.w.Flush()
+}
+
+func bashLine(history storage.History) string {
+	return fmt.Sprintf("#%d\n%s\n", history.Time.Unix(), history.Data)
+}
+
+// zshLine escapes the newlines of multi-line commands with a backslash and
+// metafies the bytes zsh uses internally, like zsh itself does.
+func zshLine(history storage.History) string {
+	duration := int64(0)
+	if !history.EndTime.IsZero() && history.EndTime.After(history.Time) {
+		duration = int64(history.EndTime.Sub(history.Time) / time.Second)
+	}
+	command := metafy(strings.Replace(history.Data, "\n", "\\\n", -1))
+	return fmt.Sprintf(": %d:%d;%s\n", history.Time.Unix(), duration, command)
+}
+
+// zshMeta is the byte zsh writes before a metafied byte, which is xored with
+// zshMetaMask.
+const (
+	zshMeta     = 0x83
+	zshMetaMask = 0x20
+)
+
+// isZshMeta reports whether zsh metafies b: NUL, Meta itself and the bytes
+// zsh uses as tokens, up to Marker.
+func isZshMeta(b byte) bool {
+	return b == 0 || (b >= zshMeta && b <= 0xa2)
+}
+
+func metafy(s string) string {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		if isZshMeta(s[i]) {
+			builder.WriteByte(zshMeta)
+			builder.WriteByte(s[i] ^ zshMetaMask)
+			continue
+		}
+		builder.WriteByte(s[i])
+	}
+	return builder.String()
+}
+
+// fishEscaper escapes commands like fish does, keeping every entry on one line.
+var fishEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func fishLine(history storage.History) string {
+	return fmt.Sprintf("- cmd: %s\n  when: %d\n", fishEscaper.Replace(history.Data), history.Time.Unix())
+}
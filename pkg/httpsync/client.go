@@ -0,0 +1,163 @@
+package httpsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// pushBatch is how many changes a single push carries.
+const pushBatch = 500
+
+// Client syncs a store with the server at URL.
+type Client struct {
+	URL   string
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient returns a client for the server at serverURL, such as
+// "http://historian.example.com:8765".
+func NewClient(serverURL, token string) *Client {
+	return &Client{
+		URL:   strings.TrimRight(serverURL, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Report sums up a Sync.
+type Report struct {
+	Pushed int
+	storage.ApplyReport
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%d pushed, %d added and %d duplicates pulled", r.Pushed, r.Added, r.Duplicates)
+}
+
+// Sync pushes the changes recorded in store since the last push, then pulls
+// the changes the other machines pushed since the last pull. Both cursors are
+// kept in store, per server, and only move once the server answered.
+func (c *Client) Sync(store *storage.Store) (Report, error) {
+	report := Report{}
+	machine, err := store.MachineID()
+	if err != nil {
+		return report, err
+	}
+	pushed, err := c.push(store, machine)
+	report.Pushed = pushed
+	if err != nil {
+		return report, fmt.Errorf("could not push: %w", err)
+	}
+	pulled, err := c.pull(store, machine)
+	report.ApplyReport = pulled
+	if err != nil {
+		return report, fmt.Errorf("could not pull: %w", err)
+	}
+	return report, nil
+}
+
+func (c *Client) push(store *storage.Store, machine string) (int, error) {
+	cursor := "push:" + c.URL
+	pushed := 0
+	for {
+		position, err := store.Cursor(cursor)
+		if err != nil {
+			return pushed, err
+		}
+		after, err := storage.ParsePosition(position)
+		if err != nil {
+			return pushed, err
+		}
+		changes, last, err := store.Changes(after, pushBatch)
+		if err != nil {
+			return pushed, err
+		}
+		if last == after {
+			return pushed, nil
+		}
+		if len(changes) > 0 {
+			var response PushResponse
+			request := PushRequest{Machine: machine, Changes: changes}
+			if err := c.do(http.MethodPost, PushPath, request, &response); err != nil {
+				return pushed, err
+			}
+			pushed += len(changes)
+		}
+		if err := store.SetCursor(cursor, strconv.FormatUint(last, 10)); err != nil {
+			return pushed, err
+		}
+	}
+}
+
+func (c *Client) pull(store *storage.Store, machine string) (storage.ApplyReport, error) {
+	cursor := "pull:" + c.URL
+	report := storage.ApplyReport{}
+	for {
+		since, err := store.Cursor(cursor)
+		if err != nil {
+			return report, err
+		}
+		query := url.Values{"since": {since}, "machine": {machine}}
+		var response PullResponse
+		if err := c.do(http.MethodGet, PullPath+"?"+query.Encode(), nil, &response); err != nil {
+			return report, err
+		}
+		if response.Cursor == since || (since == "" && response.Cursor == "0") {
+			return report, nil
+		}
+		applied, err := store.ApplyChanges(response.Changes, cursor, response.Cursor)
+		if err != nil {
+			return report, err
+		}
+		report.Added += applied.Added
+		report.Duplicates += applied.Duplicates
+	}
+}
+
+// do sends request, when not nil, as JSON and decodes the answer into response.
+func (c *Client) do(method, path string, request interface{}, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure errorResponse
+		contents, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%s: %w", resp.Status, storage.ErrDuplicateMachineID)
+		}
+		if json.Unmarshal(contents, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, failure.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
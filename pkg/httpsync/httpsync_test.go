@@ -0,0 +1,89 @@
+package httpsync_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/httpsync"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+func TestSync(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *storage.Store {
+		store, err := storage.NewStore(filepath.Join(dir, name+".db"))
+		assert.Nil(t, err)
+		return store
+	}
+	central, laptop, desktop := open("central"), open("laptop"), open("desktop")
+	defer central.Close()
+	defer laptop.Close()
+	defer desktop.Close()
+	server := httptest.NewServer(httpsync.NewHandler(central, "secret"))
+	defer server.Close()
+
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	add := func(store *storage.Store, command string, minutes int) {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"),
+			storage.SetTime(start.Add(time.Duration(minutes)*time.Minute)))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	add(laptop, "make", 0)
+	add(laptop, "make test", 1)
+	add(desktop, "git pull", 2)
+
+	client := httpsync.NewClient(server.URL+"/", "secret")
+	report, err := client.Sync(laptop)
+	assert.Nil(t, err)
+	assert.Equal(t, httpsync.Report{Pushed: 2}, report)
+	report, err = client.Sync(desktop)
+	assert.Nil(t, err)
+	assert.Equal(t, httpsync.Report{Pushed: 1, ApplyReport: storage.ApplyReport{Added: 2}}, report)
+	report, err = client.Sync(laptop)
+	assert.Nil(t, err)
+	assert.Equal(t, httpsync.Report{ApplyReport: storage.ApplyReport{Added: 1}}, report)
+
+	for _, store := range []*storage.Store{central, laptop, desktop} {
+		history, err := store.Last("/src", 10)
+		assert.Nil(t, err)
+		assert.Len(t, history, 3)
+	}
+
+	// Pushing again, as after losing the cursor, changes nothing.
+	assert.Nil(t, laptop.SetCursor("push:"+client.URL, ""))
+	report, err = client.Sync(laptop)
+	assert.Nil(t, err)
+	assert.Equal(t, httpsync.Report{Pushed: 2}, report)
+	history, err := central.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 3)
+
+	_, err = httpsync.NewClient(server.URL, "wrong").Sync(desktop)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "401")
+
+	// A copy of the laptop's database pushes other entries under its ids.
+	copied := filepath.Join(dir, "copy.db")
+	_, err = laptop.Backup(copied)
+	assert.Nil(t, err)
+	twin, err := storage.NewStore(copied)
+	assert.Nil(t, err)
+	defer twin.Close()
+	add(laptop, "make install", 3)
+	add(twin, "rm -rf build", 4)
+	_, err = client.Sync(laptop)
+	assert.Nil(t, err)
+	_, err = client.Sync(twin)
+	assert.True(t, errors.Is(err, storage.ErrDuplicateMachineID), "%v", err)
+	_, err = twin.NewMachineID()
+	assert.Nil(t, err)
+	report, err = client.Sync(twin)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Pushed)
+	assert.Equal(t, 1, report.Added)
+}
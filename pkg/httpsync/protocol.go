@@ -0,0 +1,47 @@
+// Package httpsync syncs history through a central server over HTTP. Clients
+// push the changes recorded since their push cursor and pull the changes
+// pushed by the others since their pull cursor:
+//
+//	POST /sync/push                          PushRequest -> PushResponse
+//	GET  /sync/pull?since=&machine=&limit=   PullResponse
+//
+// Every request carries "Authorization: Bearer <token>". Pushing a change id
+// the server has seen before is a no-op, so a push interrupted half way can
+// simply be repeated. A change under an id seen before that is a different
+// entry was pushed by a copy of the pushing machine's database, and the push is
+// refused with 409 Conflict.
+package httpsync
+
+import (
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// Paths served by the Handler.
+const (
+	PushPath = "/sync/push"
+	PullPath = "/sync/pull"
+)
+
+// PushRequest carries changes recorded by Machine.
+type PushRequest struct {
+	Machine string           `json:"machine"`
+	Changes []storage.Change `json:"changes"`
+}
+
+// PushResponse tells how many pushed changes were new to the server.
+type PushResponse struct {
+	Added      int `json:"added"`
+	Duplicates int `json:"duplicates"`
+}
+
+// PullResponse carries the changes after the requested cursor and the cursor
+// to ask for next. The cursor stays the same once there is nothing left.
+type PullResponse struct {
+	Changes []storage.Change `json:"changes"`
+	Cursor  string           `json:"cursor"`
+}
+
+// errorResponse is the body of failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
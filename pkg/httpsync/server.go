@@ -0,0 +1,115 @@
+package httpsync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+// maxPushSize bounds the body of a push, clients push in batches.
+const maxPushSize = 64 * 1024 * 1024
+
+// defaultPullLimit is how many changes a pull returns when no limit is asked for.
+const defaultPullLimit = 1000
+
+// Journal is what the server needs of the store it serves, see storage.Store.
+type Journal interface {
+	Receive(changes []storage.Change) (storage.ApplyReport, error)
+	Changes(after uint64, limit int) ([]storage.Change, uint64, error)
+}
+
+// NewHandler serves the sync protocol for journal to clients presenting token.
+func NewHandler(journal Journal, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PushPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "push with POST")
+			return
+		}
+		var request PushRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushSize)).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		report, err := journal.Receive(request.Changes)
+		if errors.Is(err, storage.ErrDuplicateMachineID) {
+			logrus.Warnf("refused changes pushed by %s: %v", request.Machine, err)
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			logrus.Errorf("could not store changes pushed by %s: %v", request.Machine, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logrus.Debugf("%s pushed %d changes, %d new", request.Machine, len(request.Changes), report.Added)
+		writeJSON(w, PushResponse{Added: report.Added, Duplicates: report.Duplicates})
+	})
+	mux.HandleFunc(PullPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "pull with GET")
+			return
+		}
+		query := r.URL.Query()
+		since, err := storage.ParsePosition(query.Get("since"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit := defaultPullLimit
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid limit "+value)
+				return
+			}
+		}
+		changes, last, err := journal.Changes(since, limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// The machine pulling already has what it pushed itself.
+		machine := query.Get("machine")
+		pulled := []storage.Change{}
+		for _, change := range changes {
+			if machine == "" || !strings.HasPrefix(change.ID, machine+"-") {
+				pulled = append(pulled, change)
+			}
+		}
+		writeJSON(w, PullResponse{Changes: pulled, Cursor: strconv.FormatUint(last, 10)})
+	})
+	return authenticate(token, mux)
+}
+
+// authenticate refuses requests without the bearer token.
+func authenticate(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := []byte(r.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(presented, expected) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logrus.Errorf("could not write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message})
+}
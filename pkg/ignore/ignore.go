@@ -0,0 +1,122 @@
+// Package ignore decides which commands are not worth storing, in the spirit
+// of bash's HISTIGNORE and HISTCONTROL=ignorespace.
+package ignore
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// regexPrefix marks a pattern as a regular expression rather than a glob.
+const regexPrefix = "re:"
+
+// Pattern matches whole commands.
+type Pattern struct {
+	source string
+	re     *regexp.Regexp
+}
+
+// NewPattern compiles a pattern. Patterns starting with "re:" are regular
+// expressions, searched for anywhere in the command. Other patterns are globs
+// that match the whole command like HISTIGNORE: * matches anything, including
+// slashes and spaces, ? matches one character and [...] a set of characters.
+func NewPattern(pattern string) (Pattern, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, regexPrefix))
+		if err != nil {
+			return Pattern{}, fmt.Errorf("ignore pattern %q: %w", pattern, err)
+		}
+		return Pattern{source: pattern, re: re}, nil
+	}
+	re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return Pattern{}, fmt.Errorf("ignore pattern %q: %w", pattern, err)
+	}
+	return Pattern{source: pattern, re: re}, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	inSet := false
+	// setStart is true right after the [ of a set, where ! negates it as ^
+	// does in a regexp, and a ] is part of the set.
+	setStart := false
+	for _, r := range glob {
+		switch {
+		case setStart && r == '!':
+			b.WriteRune('^')
+			continue
+		case setStart && r == ']':
+			b.WriteString(`\]`)
+		case inSet:
+			if r == ']' {
+				inSet = false
+			}
+			if r == '\\' {
+				b.WriteString(`\\`)
+				continue
+			}
+			b.WriteRune(r)
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		case r == '[':
+			inSet = true
+			b.WriteRune(r)
+			setStart = true
+			continue
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+		setStart = false
+	}
+	return b.String()
+}
+
+func (p Pattern) String() string {
+	return p.source
+}
+
+// Rules decide whether a command is ignored. The zero value ignores nothing.
+type Rules struct {
+	Patterns []Pattern
+	// Space ignores commands typed with a leading space.
+	Space bool
+	// MinLength ignores commands shorter than this many characters.
+	MinLength int
+	// MaxLength ignores commands longer than this many characters.
+	MaxLength int
+	// Program ignores the invocations of this program, historian itself.
+	Program string
+}
+
+// Match reports whether command, as it was typed, is ignored and why.
+func (r Rules) Match(command string) (bool, string) {
+	if r.Space && strings.HasPrefix(command, " ") {
+		return true, "starts with a space"
+	}
+	trimmed := strings.TrimSpace(command)
+	length := utf8.RuneCountInString(trimmed)
+	if r.MinLength > 0 && length < r.MinLength {
+		return true, fmt.Sprintf("shorter than %d characters", r.MinLength)
+	}
+	if r.MaxLength > 0 && length > r.MaxLength {
+		return true, fmt.Sprintf("longer than %d characters", r.MaxLength)
+	}
+	if r.Program != "" {
+		fields := strings.Fields(trimmed)
+		if len(fields) > 0 && filepath.Base(fields[0]) == r.Program {
+			return true, "runs " + r.Program
+		}
+	}
+	for _, pattern := range r.Patterns {
+		if pattern.re.MatchString(trimmed) {
+			return true, fmt.Sprintf("matches %q", pattern.source)
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,55 @@
+package ignore_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/ignore"
+)
+
+func TestMatch(t *testing.T) {
+	patterns := []ignore.Pattern{}
+	for _, source := range []string{"ls", "cd *", "[bf]g", "[!a-z]*", "re:^git (status|diff)$"} {
+		pattern, err := ignore.NewPattern(source)
+		assert.Nil(t, err)
+		patterns = append(patterns, pattern)
+	}
+	rules := ignore.Rules{
+		Patterns:  patterns,
+		Space:     true,
+		MinLength: 2,
+		MaxLength: 20,
+		Program:   "historian",
+	}
+	testCases := []struct {
+		command string
+		ignored bool
+	}{
+		{command: "ls", ignored: true},
+		{command: "ls -la", ignored: false},
+		{command: "cd /tmp/some dir", ignored: true},
+		{command: "cd", ignored: false},
+		{command: "fg", ignored: true},
+		{command: "./configure", ignored: true},
+		{command: "git status", ignored: true},
+		{command: "git status -s", ignored: false},
+		{command: " make deploy", ignored: true},
+		{command: "w", ignored: true},
+		{command: "echo this is far too long to keep", ignored: true},
+		{command: "historian last", ignored: true},
+		{command: "~/bin/historian today", ignored: true},
+		{command: "historians", ignored: false},
+		{command: "make test", ignored: false},
+	}
+	for _, testCase := range testCases {
+		ignored, reason := rules.Match(testCase.command)
+		assert.Equal(t, testCase.ignored, ignored, testCase.command)
+		assert.Equal(t, testCase.ignored, reason != "", testCase.command)
+	}
+
+	ignored, _ := ignore.Rules{}.Match(" ls")
+	assert.False(t, ignored)
+
+	_, err := ignore.NewPattern("re:(")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,103 @@
+// Package redact masks secrets such as tokens and passwords in commands
+// before they are stored.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Mask replaces every secret a rule finds.
+const Mask = "[REDACTED]"
+
+// secretGroup is the name of the capture group holding the secret. A rule
+// without it masks its whole match.
+const secretGroup = "secret"
+
+// Rule finds one kind of secret.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// NewRule compiles a rule. The pattern can name the part to mask with a
+// (?P<secret>...) group, otherwise the whole match is masked.
+func NewRule(name, pattern string) (Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rule{}, fmt.Errorf("redaction rule %s: %w", name, err)
+	}
+	return Rule{Name: name, Pattern: re}, nil
+}
+
+var builtin = []struct {
+	name    string
+	pattern string
+}{
+	{"aws-access-key-id", `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{"secret-assignment", `(?i)\b[a-z0-9_]*(?:secret|token|passwd|password|api_?key|access_?key|private_?key)[a-z0-9_]*\s*=\s*(?P<secret>'[^']*'|"[^"]*"|[^\s'"]+)`},
+	{"authorization-header", `(?i)\b(?:authorization|proxy-authorization)\s*:\s*(?:bearer|basic|token|digest)?\s*(?P<secret>[^\s'"]+)`},
+	{"password-flag", `(?i)(?:^|\s)--?(?:password|passwd|pass)[=\s]+(?P<secret>'[^']*'|"[^"]*"|[^\s'"]+)`},
+	{"mysql-password", `\b(?:mysql|mysqldump|mysqladmin)\b.*\s-p(?P<secret>[^\s'"]+)`},
+	{"url-credentials", `(?i)\b[a-z][a-z0-9+.-]*://[^/\s:@]+:(?P<secret>[^@\s/]+)@`},
+	{"github-token", `\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`},
+	{"slack-token", `\bxox[abposr]-[A-Za-z0-9-]{10,}\b`},
+	{"stripe-key", `\b[rs]k_live_[0-9A-Za-z]{20,}\b`},
+	{"google-api-key", `\bAIza[0-9A-Za-z_-]{35}\b`},
+	{"jwt", `\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\b`},
+}
+
+// Builtin returns the rules for common secret shapes.
+func Builtin() []Rule {
+	rules := make([]Rule, 0, len(builtin))
+	for _, b := range builtin {
+		rules = append(rules, Rule{Name: b.name, Pattern: regexp.MustCompile(b.pattern)})
+	}
+	return rules
+}
+
+// Redactor applies a set of rules.
+type Redactor struct {
+	rules []Rule
+}
+
+// New returns a redactor applying rules in order.
+func New(rules ...Rule) *Redactor {
+	return &Redactor{rules: rules}
+}
+
+// Redact masks the secrets in text and returns the names of the rules that
+// found any. A nil redactor leaves text alone.
+func (r *Redactor) Redact(text string) (string, []string) {
+	if r == nil {
+		return text, nil
+	}
+	matched := []string{}
+	for _, rule := range r.rules {
+		redacted := mask(rule.Pattern, text)
+		if redacted != text {
+			matched = append(matched, rule.Name)
+			text = redacted
+		}
+	}
+	return text, matched
+}
+
+func mask(re *regexp.Regexp, text string) string {
+	group := re.SubexpIndex(secretGroup)
+	if group < 0 {
+		return re.ReplaceAllLiteralString(text, Mask)
+	}
+	result := []byte{}
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2*group], match[2*group+1]
+		if start < 0 {
+			continue
+		}
+		result = append(result, text[last:start]...)
+		result = append(result, Mask...)
+		last = end
+	}
+	return string(append(result, text[last:]...))
+}
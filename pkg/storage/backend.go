@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"time"
+)
+
+// HistoryStore is implemented by every storage backend. An empty directory
+// passed to Range or Last means every directory.
+type HistoryStore interface {
+	Add(history *History) error
+	Get(directory, key string) (*History, error)
+	Delete(directory, key string) error
+	Range(directory string, minTime, maxTime time.Time, handler HistoryHandler) error
+	Last(directory string, numEntries int, filters ...FilterFunction) ([]History, error)
+	Greps(regexes ...string) ([]History, error)
+	Usage(directory string) ([]Usage, error)
+	Close()
+}
+
+var (
+	_ HistoryStore = (*Store)(nil)
+	_ HistoryStore = (*MemoryStore)(nil)
+)
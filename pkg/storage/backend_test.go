@@ -0,0 +1,339 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/storage"
+)
+
+func TestFilter(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+	timestamp1 := time.Date(2020, 1, 1, 0, 0, 0, 0, &time.Location{})
+	fmt.Println(timestamp1.Format(time.RFC3339), "......!")
+	data := []struct {
+		directory string
+		timestamp time.Time
+		command   string
+	}{
+		{
+			directory: "/tmp",
+			timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, &time.Location{}),
+			command:   "echo hello world",
+		},
+		{
+			directory: "/dir1",
+			timestamp: time.Date(2020, 1, 1, 23, 55, 55, 55, &time.Location{}),
+			command:   "echo bye world",
+		},
+		{
+			directory: "/dir2",
+			timestamp: time.Date(2020, 1, 2, 1, 0, 2, 0, &time.Location{}),
+			command:   "printf '%s..' bye",
+		},
+		{
+			directory: "/home/user",
+			timestamp: time.Date(2020, 1, 1, 1, 1, 2, 0, &time.Location{}),
+			command:   "printf 'sneaky %s' hello",
+		},
+		{
+			directory: "/home/user2",
+			timestamp: time.Date(2020, 1, 2, 1, 2, 2, 0, &time.Location{}),
+			command: `cat<<"EOF" > test
+			bla hello
+			EOF
+			`,
+		},
+	}
+
+	for _, datum := range data {
+		history, err := storage.NewHistory(
+			datum.command,
+			storage.SetDirectory(datum.directory),
+			storage.SetTime(datum.timestamp),
+		)
+		assert.Nil(t, err)
+		err = store.Add(history)
+		assert.Nil(t, err)
+	}
+
+	testCases := []struct {
+		matches    []string
+		matchCount int
+	}{
+		{
+			matches:    []string{"hello"},
+			matchCount: 3,
+		},
+		{
+			matches: []string{
+				"hello", "world",
+			},
+			matchCount: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		history, err := store.Greps(testCase.matches...)
+		assert.Nil(t, err)
+		fmt.Printf("HISTORY LENGTH::: %d \n", len(history))
+		for _, h := range history {
+			fmt.Printf("----> %s\n", h)
+		}
+		assert.Equal(t, testCase.matchCount, len(history))
+	}
+}
+
+func TestSameSecondEntries(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, &time.Location{})
+	commands := []string{"make clean", "make", "make test"}
+	for _, command := range commands {
+		history, err := storage.NewHistory(
+			command,
+			storage.SetDirectory("/tmp"),
+			storage.SetTime(timestamp),
+			storage.SetAnnotation("build "+command),
+		)
+		assert.Nil(t, err)
+		err = store.Add(history)
+		assert.Nil(t, err)
+	}
+
+	lastEntries, err := store.Last("/tmp", 10)
+	assert.Nil(t, err)
+	assert.Len(t, lastEntries, 3)
+	for i, entry := range lastEntries {
+		expected := commands[len(commands)-1-i]
+		assert.Equal(t, expected, entry.Data)
+		assert.Equal(t, "build "+expected, entry.Annotation)
+		assert.True(t, timestamp.Equal(entry.Time))
+	}
+
+	rangeCount := 0
+	err = store.Range("/tmp", timestamp, timestamp, func(h storage.History) error {
+		rangeCount++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, rangeCount)
+
+	entry, err := store.Get("/tmp", lastEntries[1].Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "make", entry.Data)
+	assert.Equal(t, "build make", entry.Annotation)
+}
+
+func TestRecordFields(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	history, err := storage.NewHistory(
+		"make test",
+		storage.SetDirectory("/src"),
+		storage.SetTime(start),
+		storage.SetEndTime(start.Add(90*time.Second)),
+		storage.SetExitCode(2),
+		storage.SetSession("abc123"),
+		storage.SetHostname("laptop"),
+		storage.SetUsername("alice"),
+		storage.SetShell("bash"),
+		storage.SetTTY("/dev/pts/3"),
+		storage.SetID(42),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(history))
+
+	entry, err := store.Get("/src", history.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "make test", entry.Data)
+	assert.Equal(t, 2, entry.ExitCode)
+	assert.Equal(t, 90*time.Second, entry.Duration())
+	assert.Equal(t, "abc123", entry.SessionID)
+	assert.Equal(t, "laptop", entry.Hostname)
+	assert.Equal(t, "alice", entry.Username)
+	assert.Equal(t, "bash", entry.Shell)
+	assert.Equal(t, "/dev/pts/3", entry.TTY)
+	assert.Equal(t, int64(42), entry.ID)
+	assert.Contains(t, entry.Details(), "exit=2 took=1m30s user=alice host=laptop shell=bash")
+
+	results, err := store.Greps("make")
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	results, err = store.Greps("laptop")
+	assert.Nil(t, err)
+	assert.Len(t, results, 0)
+}
+
+func TestChronologicalIndex(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+
+	data := []struct {
+		directory string
+		timestamp time.Time
+		command   string
+	}{
+		{directory: "/b", timestamp: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), command: "third"},
+		{directory: "/a", timestamp: time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC), command: "first"},
+		{directory: "/c", timestamp: time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), command: "second"},
+		{directory: "/a", timestamp: time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC), command: "tomorrow"},
+		{directory: "/b", timestamp: time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC), command: "yesterday"},
+	}
+	for _, datum := range data {
+		history, err := storage.NewHistory(
+			datum.command,
+			storage.SetDirectory(datum.directory),
+			storage.SetTime(datum.timestamp),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+
+	day := []string{}
+	bod, eod := storage.DayBounds(time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC))
+	err = store.Range("", bod, eod, func(h storage.History) error {
+		day = append(day, h.Data)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second", "third"}, day)
+
+	latest, err := store.Last("", 2)
+	assert.Nil(t, err)
+	assert.Len(t, latest, 2)
+	assert.Equal(t, "tomorrow", latest[0].Data)
+	assert.Equal(t, "/a", latest[0].DirectoryName)
+	assert.Equal(t, "third", latest[1].Data)
+}
+
+func TestDelete(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	keys := []string{}
+	for _, command := range []string{"ls", "pwd"} {
+		history, err := storage.NewHistory(
+			command,
+			storage.SetDirectory("/tmp"),
+			storage.SetTime(timestamp),
+			storage.SetAnnotation("note"),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+		keys = append(keys, history.Key)
+	}
+
+	assert.Nil(t, store.Delete("/tmp", keys[0]))
+	assert.NotNil(t, store.Delete("/tmp", keys[0]))
+	_, err = store.Get("/tmp", keys[0])
+	assert.NotNil(t, err)
+
+	entries, err := store.Last("", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "pwd", entries[0].Data)
+
+	_, err = store.Last("/nowhere", 10)
+	assert.NotNil(t, err)
+}
+
+func TestUsage(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	data := []struct {
+		directory string
+		command   string
+	}{
+		{directory: "/a", command: "make"},
+		{directory: "/a", command: "make "},
+		{directory: "/b", command: "make"},
+		{directory: "/b", command: "ls"},
+	}
+	for i, datum := range data {
+		history, err := storage.NewHistory(
+			datum.command,
+			storage.SetDirectory(datum.directory),
+			storage.SetTime(timestamp.Add(time.Duration(i)*time.Minute)),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+
+	usages, err := store.Usage("/a")
+	assert.Nil(t, err)
+	assert.Len(t, usages, 1)
+	assert.Equal(t, 2, usages[0].Count)
+	assert.Equal(t, "/a", usages[0].Directory)
+
+	usages, err = store.Usage("")
+	assert.Nil(t, err)
+	assert.Len(t, usages, 3)
+	merged := storage.MergeUsage(usages)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, "ls", merged[0].Command)
+	assert.Equal(t, "make", merged[1].Command)
+	assert.Equal(t, 3, merged[1].Count)
+
+	entries, err := store.Last("/b", 1)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Delete("/b", entries[0].Key))
+	usages, err = store.Usage("/b")
+	assert.Nil(t, err)
+	assert.Len(t, usages, 1)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := storage.NewMemoryStore()
+	defer store.Close()
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i, command := range []string{"make", "make", "curl -H token", "ls"} {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"),
+			storage.SetTime(timestamp.Add(time.Duration(i)*time.Minute)))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+		assert.NotEmpty(t, history.Key)
+	}
+
+	// Kept as given, repeats and all.
+	entries, err := store.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "ls", entries[0].Data)
+	assert.Equal(t, "curl -H token", entries[1].Data)
+	entry, err := store.Get("/src", entries[3].Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "make", entry.Data)
+	_, err = store.Last("/nowhere", 10)
+	assert.NotNil(t, err)
+
+	entries, err = store.Greps("^make$")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	count := 0
+	err = store.Range("", timestamp, timestamp.Add(time.Minute), func(h storage.History) error {
+		count++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	usages, err := store.Usage("/src")
+	assert.Nil(t, err)
+	assert.Len(t, usages, 3)
+	assert.Equal(t, "ls", usages[0].Command)
+	assert.Equal(t, "make", usages[2].Command)
+	assert.Equal(t, 2, usages[2].Count)
+	assert.Nil(t, store.Delete("/src", entries[0].Key))
+	assert.NotNil(t, store.Delete("/src", entries[0].Key))
+	usages, err = store.Usage("/src")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, usages[2].Count)
+}
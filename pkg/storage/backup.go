@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// backupTimeFormat sorts the same way as the time it formats.
+const backupTimeFormat = "20060102T150405Z"
+
+// BackupFileName is the name of a backup taken at t, as RotateBackups expects it.
+func BackupFileName(t time.Time) string {
+	return "history-" + t.UTC().Format(backupTimeFormat) + ".db"
+}
+
+// Backup writes a consistent snapshot of the database to path. It runs in a
+// read transaction, so the store stays usable while the snapshot is written.
+// It returns the size of the snapshot.
+func (s *Store) Backup(path string) (int64, error) {
+	partial := path + ".partial"
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return tx.CopyFile(partial, 0600)
+	})
+	if err != nil {
+		os.Remove(partial)
+		return 0, err
+	}
+	if err := syncFile(partial); err != nil {
+		os.Remove(partial)
+		return 0, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		os.Remove(partial)
+		return 0, err
+	}
+	return size, nil
+}
+
+// RotateBackups removes all but the newest keep backups in dir, and returns
+// the removed files. Only files named by BackupFileName are considered.
+func RotateBackups(dir string, keep int) ([]string, error) {
+	backups, err := filepath.Glob(filepath.Join(dir, "history-*.db"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	removed := []string{}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return removed, err
+		}
+		removed = append(removed, backups[0])
+		backups = backups[1:]
+	}
+	return removed, nil
+}
+
+// ValidateBackup checks that path is an intact historian database this
+// version can open, and returns its schema version.
+func ValidateBackup(path string) (int, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a database: %w", path, err)
+	}
+	defer db.Close()
+	var version int
+	err = db.View(func(tx *bolt.Tx) error {
+		var problems []error
+		for err := range tx.Check() {
+			problems = append(problems, err)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%s is corrupt: %v", path, problems[0])
+		}
+		var err error
+		version, err = readSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			return fmt.Errorf("%s is empty", path)
+		}
+		if version > SchemaVersion() {
+			return fmt.Errorf("%s has schema version %d, this historian only knows up to %d", path, version, SchemaVersion())
+		}
+		return nil
+	})
+	return version, err
+}
+
+// ErrRestoreIncomplete is returned by Restore when the snapshot took the
+// database's place but could not be opened there. The database is then
+// neither, and should be put back from a copy taken before.
+var ErrRestoreIncomplete = errors.New("the snapshot replaced the database but could not be opened")
+
+// Restore replaces the database with the snapshot at path, after validating
+// it. An older snapshot is migrated unless migrations are disabled. An
+// encrypted snapshot needs the secret the store was opened with, and an
+// unencrypted one a store opened without. The restored database syncs under a
+// new machine id. The database is only replaced once a copy of the snapshot
+// opened, so a snapshot that can not be used leaves it as it was.
+func (s *Store) Restore(path string) error {
+	if _, err := ValidateBackup(path); err != nil {
+		return err
+	}
+	restored := s.db.Path() + ".restore"
+	if err := copyFile(restored, path); err != nil {
+		os.Remove(restored)
+		return err
+	}
+	if err := s.prepareRestore(restored); err != nil {
+		os.Remove(restored)
+		return err
+	}
+	if err := s.replace(restored); err != nil {
+		return fmt.Errorf("%w: %v", ErrRestoreIncomplete, err)
+	}
+	if err := s.unlock(); err != nil {
+		return fmt.Errorf("%w: %v", ErrRestoreIncomplete, err)
+	}
+	return nil
+}
+
+// prepareRestore migrates the copy of a snapshot at file and unlocks it with
+// the store's secret, as NewStore would. The snapshot's journal is behind the
+// changes already synced under its machine id, so it gets a new one.
+func (s *Store) prepareRestore(file string) error {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	staged := &Store{
+		db:             db,
+		directoryFunc:  s.directoryFunc,
+		timeFunc:       s.timeFunc,
+		skipMigrations: s.skipMigrations,
+		secret:         s.secret,
+		redactor:       s.redactor,
+	}
+	defer staged.Close()
+	if !staged.skipMigrations {
+		if _, err := staged.Migrate(false); err != nil {
+			return fmt.Errorf("could not migrate the snapshot: %w", err)
+		}
+	}
+	if err := staged.unlock(); err != nil {
+		return err
+	}
+	_, err = staged.NewMachineID()
+	return err
+}
+
+// replace swaps file in place of the database. The original is replaced while
+// its lock is still held, so a process waiting for the lock notices the swap
+// and opens the new file, see open.
+func (s *Store) replace(file string) error {
+	path := s.db.Path()
+	if err := os.Rename(file, path); err != nil {
+		os.Remove(file)
+		return err
+	}
+	s.db.Close()
+	return s.open(path)
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
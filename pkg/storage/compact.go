@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Compact rewrites the database into a fresh file, leaving out the free pages
+// bbolt keeps after deletions, and swaps it in place of the original. It
+// returns the size of the file before and after.
+func (s *Store) Compact() (int64, int64, error) {
+	path := s.db.Path()
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	compacted := path + ".compact"
+	if err := os.Remove(compacted); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	dst, err := bolt.Open(compacted, info.Mode(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = s.db.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+				child, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return compactBucket(child, b)
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(compacted)
+		return 0, 0, err
+	}
+
+	if err := s.replace(compacted); err != nil {
+		return 0, 0, err
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), after.Size(), nil
+}
+
+// compactBucket copies src into dst like copyBucket, filling every page
+// since the keys arrive in order.
+func compactBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	dst.FillPercent = 1.0
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return compactBucket(child, src.Bucket(k))
+	})
+}
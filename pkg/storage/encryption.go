@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted database seals the records, the annotations and the run counts
+// with AES-256-GCM. Entry keys and directory names stay readable, the range
+// and day queries depend on their ordering. The run counts are keyed by a
+// HMAC of the command instead of the command itself. The parameters needed
+// to derive the key again are kept in the meta bucket.
+var encryptionKey = []byte("encryption")
+
+var (
+	// ErrEncrypted is returned when an encrypted database is opened without a secret.
+	ErrEncrypted = errors.New("database is encrypted, a passphrase or key file is needed")
+	// ErrNotEncrypted is returned when a secret is given for a database that
+	// already holds unencrypted history, it has to be encrypted with Rekey.
+	ErrNotEncrypted = errors.New("database is not encrypted, run historian rekey to encrypt it")
+	// ErrWrongSecret is returned when the secret does not unlock the database.
+	ErrWrongSecret = errors.New("wrong passphrase or key file")
+)
+
+const (
+	cipherAESGCM = "aes-256-gcm"
+	kdfScrypt    = "scrypt"
+	kdfHMAC      = "hmac-sha256"
+)
+
+// encryptionParams is stored in the meta bucket of an encrypted database.
+type encryptionParams struct {
+	Cipher string `json:"cipher"`
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	N      int    `json:"n,omitempty"`
+	R      int    `json:"r,omitempty"`
+	P      int    `json:"p,omitempty"`
+	// Check is a sealed known value, telling a wrong secret from a corrupt record.
+	Check []byte `json:"check"`
+}
+
+var checkValue = []byte("historian")
+
+// Secret unlocks an encrypted database, see WithSecret. A passphrase is only
+// stretched once per salt, so a process can open the database again with the
+// same Secret without the wait.
+type Secret struct {
+	kdf   string
+	value []byte
+
+	mu      sync.Mutex
+	masters map[string][]byte
+}
+
+// Passphrase is a secret typed by a person. It is stretched with scrypt,
+// which makes every open of the database take a moment.
+func Passphrase(passphrase string) *Secret {
+	return &Secret{kdf: kdfScrypt, value: []byte(passphrase)}
+}
+
+// KeyFile reads a secret of random bytes from path, such as one made with
+// "head -c 32 /dev/urandom". It is not stretched, so opening stays fast.
+func KeyFile(path string) (*Secret, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) < 16 {
+		return nil, fmt.Errorf("key file %s is too short, use at least 16 random bytes", path)
+	}
+	return &Secret{kdf: kdfHMAC, value: value}, nil
+}
+
+// WithSecret unlocks an encrypted database. A new, empty database is
+// encrypted with it.
+func WithSecret(secret *Secret) StoreOption {
+	return func(s *Store) error {
+		s.secret = secret
+		return nil
+	}
+}
+
+// keyring seals and opens stored values. A nil keyring leaves them as they are.
+type keyring struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func newParams(secret *Secret) (*encryptionParams, error) {
+	params := &encryptionParams{Cipher: cipherAESGCM, KDF: secret.kdf, Salt: make([]byte, 32)}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, err
+	}
+	if secret.kdf == kdfScrypt {
+		params.N, params.R, params.P = 1<<15, 8, 1
+	}
+	keys, err := deriveKeyring(secret, params)
+	if err != nil {
+		return nil, err
+	}
+	params.Check, err = keys.seal(checkValue, metaBucket)
+	return params, err
+}
+
+func deriveKeyring(secret *Secret, params *encryptionParams) (*keyring, error) {
+	if params.Cipher != cipherAESGCM {
+		return nil, fmt.Errorf("unsupported cipher %q", params.Cipher)
+	}
+	var master []byte
+	switch params.KDF {
+	case kdfScrypt:
+		var err error
+		master, err = secret.stretch(params)
+		if err != nil {
+			return nil, err
+		}
+	case kdfHMAC:
+		master = subkey(params.Salt, string(secret.value))
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %q", params.KDF)
+	}
+	block, err := aes.NewCipher(subkey(master, "historian values"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{aead: aead, macKey: subkey(master, "historian commands")}, nil
+}
+
+// stretch derives the master key of a passphrase with scrypt, remembering it
+// for the next open.
+func (s *Secret) stretch(params *encryptionParams) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := fmt.Sprintf("%x/%d/%d/%d", params.Salt, params.N, params.R, params.P)
+	if master, ok := s.masters[id]; ok {
+		return master, nil
+	}
+	master, err := scrypt.Key(s.value, params.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	if s.masters == nil {
+		s.masters = map[string][]byte{}
+	}
+	s.masters[id] = master
+	return master, nil
+}
+
+func subkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// additionalData binds a sealed value to where it is stored, so values can
+// not be swapped between entries unnoticed.
+func additionalData(location [][]byte) []byte {
+	return bytes.Join(location, []byte{0})
+}
+
+// seal encrypts value stored at location, such as namespace, directory and key.
+func (k *keyring) seal(value []byte, location ...[]byte) ([]byte, error) {
+	if k == nil {
+		return value, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(value)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, value, additionalData(location)), nil
+}
+
+// open decrypts a value sealed at location.
+func (k *keyring) open(sealed []byte, location ...[]byte) ([]byte, error) {
+	if k == nil {
+		return sealed, nil
+	}
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	value, err := k.aead.Open(nil, nonce, ciphertext, additionalData(location))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt: %w", err)
+	}
+	return value, nil
+}
+
+// commandKey is the key of a command in the commands bucket.
+func (k *keyring) commandKey(normalized string) []byte {
+	if k == nil {
+		return []byte(normalized)
+	}
+	return subkey(k.macKey, normalized)
+}
+
+func readParams(tx *bolt.Tx) (*encryptionParams, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return nil, nil
+	}
+	value := meta.Get(encryptionKey)
+	if value == nil {
+		return nil, nil
+	}
+	var params encryptionParams
+	if err := json.Unmarshal(value, &params); err != nil {
+		return nil, fmt.Errorf("could not read encryption parameters: %w", err)
+	}
+	return &params, nil
+}
+
+func writeParams(tx *bolt.Tx, params *encryptionParams) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		return meta.Delete(encryptionKey)
+	}
+	value, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return meta.Put(encryptionKey, value)
+}
+
+// isEmpty reports whether no history was stored yet.
+func isEmpty(tx *bolt.Tx) bool {
+	empty := true
+	forEachDirectory(tx, func(name []byte, b *bolt.Bucket) error {
+		if k, _ := b.Cursor().First(); k != nil {
+			empty = false
+		}
+		return nil
+	})
+	return empty
+}
+
+// unlock derives the keyring from the secret. A migrated database without
+// history is encrypted with the secret on the spot.
+func (s *Store) unlock() error {
+	var params *encryptionParams
+	empty := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		params, err = readParams(tx)
+		if err != nil {
+			return err
+		}
+		// Older layouts keep history where isEmpty does not look.
+		version, err := readSchemaVersion(tx)
+		empty = version == SchemaVersion() && isEmpty(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case params == nil && s.secret == nil:
+		s.keys = nil
+		return nil
+	case params == nil && !empty:
+		return ErrNotEncrypted
+	case params == nil:
+		params, err = newParams(s.secret)
+		if err != nil {
+			return err
+		}
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return writeParams(tx, params)
+		})
+		if err != nil {
+			return err
+		}
+	case s.secret == nil:
+		return ErrEncrypted
+	}
+	keys, err := deriveKeyring(s.secret, params)
+	if err != nil {
+		return err
+	}
+	check, err := keys.open(params.Check, metaBucket)
+	if err != nil || !bytes.Equal(check, checkValue) {
+		return ErrWrongSecret
+	}
+	s.keys = keys
+	return nil
+}
+
+// Encrypted reports whether the database is encrypted.
+func (s *Store) Encrypted() bool {
+	return s.keys != nil
+}
+
+// Rekey encrypts the database with secret, replacing the secret it was opened
+// with. A nil secret decrypts it. Quarantined records are resealed as well,
+// except those that could not be opened in the first place. The old values
+// stay in the free pages of the file until it is compacted.
+func (s *Store) Rekey(secret *Secret) error {
+	var params *encryptionParams
+	var keys *keyring
+	if secret != nil {
+		var err error
+		params, err = newParams(secret)
+		if err != nil {
+			return err
+		}
+		keys, err = deriveKeyring(secret, params)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, namespace := range [][]byte{dirsBucket, annotationsBucket} {
+			err := forEachNestedBucket(tx, namespace, func(directory []byte, b *bolt.Bucket) error {
+				return resealBucket(b, func(k, v []byte) ([]byte, []byte, error) {
+					value, err := s.keys.open(v, namespace, directory, k)
+					if err != nil {
+						return nil, nil, fmt.Errorf("%s/%s %s: %w", namespace, directory, k, err)
+					}
+					value, err = keys.seal(value, namespace, directory, k)
+					return k, value, err
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := forEachNestedBucket(tx, commandsBucket, func(directory []byte, b *bolt.Bucket) error {
+			return resealBucket(b, func(k, v []byte) ([]byte, []byte, error) {
+				value, err := s.keys.open(v, commandsBucket, directory, k)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s/%s: %w", commandsBucket, directory, err)
+				}
+				var usage Usage
+				if err := json.Unmarshal(value, &usage); err != nil {
+					return nil, nil, err
+				}
+				key := keys.commandKey(usage.Command)
+				value, err = keys.seal(value, commandsBucket, directory, key)
+				return key, value, err
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachNestedBucket(tx, quarantineBucket, func(namespace []byte, qb *bolt.Bucket) error {
+			return qb.ForEach(func(directory, v []byte) error {
+				if v != nil {
+					return nil
+				}
+				return resealBucket(qb.Bucket(directory), func(k, v []byte) ([]byte, []byte, error) {
+					value, err := s.keys.open(v, namespace, directory, k)
+					if err != nil {
+						// It was quarantined because it could not be
+						// opened, leave it as it was found.
+						return k, v, nil
+					}
+					value, err = keys.seal(value, namespace, directory, k)
+					return k, value, err
+				})
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return writeParams(tx, params)
+	})
+	if err != nil {
+		return err
+	}
+	s.secret, s.keys = secret, keys
+	return nil
+}
+
+// resealBucket replaces every value of b, and possibly its key, with what
+// reseal returns.
+func resealBucket(b *bolt.Bucket, reseal func(k, v []byte) ([]byte, []byte, error)) error {
+	type pair struct{ key, value []byte }
+	resealed := []pair{}
+	old := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		key, value, err := reseal(k, v)
+		if err != nil {
+			return err
+		}
+		old = append(old, append([]byte{}, k...))
+		resealed = append(resealed, pair{append([]byte{}, key...), value})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for _, p := range resealed {
+		if err := b.Put(p.key, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// quarantineBucket keeps the records fsck took out of the way, as they were
+// found:
+//
+//	quarantine/<namespace>/<directory>  key -> value
+var quarantineBucket = []byte("quarantine")
+
+// ProblemKind names a kind of inconsistency found by Fsck.
+type ProblemKind string
+
+// Problems Fsck reports.
+const (
+	CorruptPage      ProblemKind = "corrupt page"
+	BadKey           ProblemKind = "unparsable key"
+	BadRecord        ProblemKind = "undecodable value"
+	InvalidUTF8      ProblemKind = "invalid UTF-8"
+	OrphanAnnotation ProblemKind = "annotation without entry"
+	EmptyBucket      ProblemKind = "empty bucket"
+	MissingIndex     ProblemKind = "entry missing from index"
+	DanglingIndex    ProblemKind = "index without entry"
+)
+
+// Problem is one inconsistency. Namespace and Directory locate the bucket,
+// Key is empty for problems with the bucket itself. Repair says what Fsck did
+// about it, if anything.
+type Problem struct {
+	Kind      ProblemKind
+	Namespace string
+	Directory string
+	Key       string
+	Detail    string
+	Repair    string
+}
+
+func (p Problem) String() string {
+	location := p.Namespace
+	if p.Directory != "" {
+		location += "/" + p.Directory
+	}
+	if p.Key != "" {
+		location += fmt.Sprintf(" %q", p.Key)
+	}
+	message := fmt.Sprintf("%s: %s", location, p.Kind)
+	if p.Detail != "" {
+		message += " (" + p.Detail + ")"
+	}
+	if p.Repair != "" {
+		message += ", " + p.Repair
+	}
+	return message
+}
+
+// Fsck checks the pages of the database file and then every bucket. With
+// repair, bad records are moved to the quarantine bucket, annotations without
+// an entry as well, empty buckets are removed and the index is fixed up. Run
+// counts are left alone, the quarantined commands did run.
+// Nothing is repaired when the pages are corrupt, restore a backup instead.
+func (s *Store) Fsck(repair bool) ([]Problem, error) {
+	problems := []Problem{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, Problem{Kind: CorruptPage, Namespace: "file", Detail: err.Error()})
+		}
+		return nil
+	})
+	if err != nil || len(problems) > 0 {
+		return problems, err
+	}
+
+	check := func(tx *bolt.Tx) error {
+		f := &fsck{tx: tx, keys: s.keys, repair: repair}
+		for _, step := range []func() error{f.checkDirectories, f.checkAnnotations, f.checkIndex, f.checkCommands} {
+			if err := step(); err != nil {
+				return err
+			}
+		}
+		problems = f.problems
+		return nil
+	}
+	if repair {
+		err = s.db.Update(check)
+	} else {
+		err = s.db.View(check)
+	}
+	return problems, err
+}
+
+type fsck struct {
+	tx       *bolt.Tx
+	keys     *keyring
+	repair   bool
+	problems []Problem
+}
+
+// finding is a problem together with the fix applied in repair mode.
+type finding struct {
+	problem Problem
+	fix     func() error
+}
+
+// report records the findings, applying their fixes in repair mode. Fixes run
+// after the bucket was walked, bbolt does not allow changes while iterating.
+func (f *fsck) report(findings []finding) error {
+	for _, found := range findings {
+		if f.repair && found.fix != nil {
+			if err := found.fix(); err != nil {
+				return err
+			}
+		} else {
+			found.problem.Repair = ""
+		}
+		f.problems = append(f.problems, found.problem)
+	}
+	return nil
+}
+
+// forEachNested visits the buckets of a namespace. A bucket left empty once
+// its records are checked is reported, and removed in repair mode.
+func (f *fsck) forEachNested(namespace []byte, check func(directory []byte, b *bolt.Bucket) ([]finding, error)) error {
+	parent := f.tx.Bucket(namespace)
+	if parent == nil {
+		return nil
+	}
+	names := [][]byte{}
+	err := parent.ForEach(func(name, value []byte) error {
+		if value == nil {
+			names = append(names, append([]byte{}, name...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		findings, err := check(name, parent.Bucket(name))
+		if err != nil {
+			return err
+		}
+		if err := f.report(findings); err != nil {
+			return err
+		}
+		if k, _ := parent.Bucket(name).Cursor().First(); k != nil {
+			continue
+		}
+		name := name
+		err = f.report([]finding{{
+			problem: Problem{Kind: EmptyBucket, Namespace: string(namespace), Directory: string(name), Repair: "removed"},
+			fix:     func() error { return parent.DeleteBucket(name) },
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine moves a record of namespace/directory into the quarantine bucket.
+func (f *fsck) quarantine(namespace, directory, key []byte) error {
+	b := nestedBucket(f.tx, namespace, directory)
+	if b == nil {
+		return nil
+	}
+	value := b.Get(key)
+	if value == nil {
+		return nil
+	}
+	qb, err := createNestedBucket(f.tx, quarantineBucket, namespace)
+	if err != nil {
+		return err
+	}
+	qb, err = qb.CreateBucketIfNotExists(directory)
+	if err != nil {
+		return err
+	}
+	if err := qb.Put(key, value); err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+func (f *fsck) checkDirectories() error {
+	index := f.tx.Bucket(indexBucket)
+	return f.forEachNested(dirsBucket, func(directory []byte, b *bolt.Bucket) ([]finding, error) {
+		findings := []finding{}
+		err := b.ForEach(func(k, v []byte) error {
+			key := append([]byte{}, k...)
+			problem := Problem{Namespace: string(dirsBucket), Directory: string(directory), Key: string(key)}
+			var history History
+			value, openErr := f.keys.open(v, dirsBucket, directory, key)
+			if _, _, err := ParseKey(key); err != nil {
+				problem.Kind = BadKey
+			} else if openErr != nil {
+				problem.Kind, problem.Detail = BadRecord, openErr.Error()
+			} else if !utf8.Valid(value) {
+				problem.Kind = InvalidUTF8
+			} else if err := decodeRecord(value, &history); err != nil {
+				problem.Kind, problem.Detail = BadRecord, err.Error()
+			} else if index == nil || index.Get(indexKey(key, directory)) == nil {
+				problem.Kind, problem.Repair = MissingIndex, "indexed"
+				findings = append(findings, finding{problem, func() error {
+					return addToIndex(f.tx, key, directory)
+				}})
+				return nil
+			} else {
+				return nil
+			}
+			problem.Repair = "quarantined"
+			findings = append(findings, finding{problem, func() error {
+				if err := f.quarantine(dirsBucket, directory, key); err != nil {
+					return err
+				}
+				if err := f.quarantine(annotationsBucket, directory, key); err != nil {
+					return err
+				}
+				if index == nil {
+					return nil
+				}
+				return index.Delete(indexKey(key, directory))
+			}})
+			return nil
+		})
+		return findings, err
+	})
+}
+
+func (f *fsck) checkAnnotations() error {
+	return f.forEachNested(annotationsBucket, func(directory []byte, b *bolt.Bucket) ([]finding, error) {
+		entries := directoryBucket(f.tx, directory)
+		findings := []finding{}
+		err := b.ForEach(func(k, v []byte) error {
+			key := append([]byte{}, k...)
+			problem := Problem{Namespace: string(annotationsBucket), Directory: string(directory), Key: string(key)}
+			value, openErr := f.keys.open(v, annotationsBucket, directory, key)
+			if entries == nil || entries.Get(key) == nil {
+				problem.Kind = OrphanAnnotation
+			} else if openErr != nil {
+				problem.Kind, problem.Detail = BadRecord, openErr.Error()
+			} else if !utf8.Valid(value) {
+				problem.Kind = InvalidUTF8
+			} else {
+				return nil
+			}
+			problem.Repair = "quarantined"
+			findings = append(findings, finding{problem, func() error {
+				return f.quarantine(annotationsBucket, directory, key)
+			}})
+			return nil
+		})
+		return findings, err
+	})
+}
+
+func (f *fsck) checkIndex() error {
+	index := f.tx.Bucket(indexBucket)
+	if index == nil {
+		return nil
+	}
+	findings := []finding{}
+	err := index.ForEach(func(k, v []byte) error {
+		indexed := append([]byte{}, k...)
+		key, directory, err := splitIndexKey(indexed)
+		if err == nil {
+			if b := directoryBucket(f.tx, directory); b != nil && b.Get(key) != nil {
+				return nil
+			}
+		}
+		findings = append(findings, finding{
+			problem: Problem{Kind: DanglingIndex, Namespace: string(indexBucket), Key: string(indexed), Repair: "removed"},
+			fix:     func() error { return index.Delete(indexed) },
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.report(findings)
+}
+
+func (f *fsck) checkCommands() error {
+	return f.forEachNested(commandsBucket, func(directory []byte, b *bolt.Bucket) ([]finding, error) {
+		findings := []finding{}
+		err := b.ForEach(func(k, v []byte) error {
+			key := append([]byte{}, k...)
+			problem := Problem{Namespace: string(commandsBucket), Directory: string(directory), Key: string(key)}
+			var usage Usage
+			// Encrypted databases key the counts by a HMAC, which is binary.
+			value, openErr := f.keys.open(v, commandsBucket, directory, key)
+			if openErr != nil {
+				problem.Kind, problem.Detail = BadRecord, openErr.Error()
+			} else if (f.keys == nil && !utf8.Valid(key)) || !utf8.Valid(value) {
+				problem.Kind = InvalidUTF8
+			} else if err := json.Unmarshal(value, &usage); err != nil {
+				problem.Kind, problem.Detail = BadRecord, err.Error()
+			} else {
+				return nil
+			}
+			problem.Repair = "quarantined"
+			findings = append(findings, finding{problem, func() error {
+				return f.quarantine(commandsBucket, directory, key)
+			}})
+			return nil
+		})
+		return findings, err
+	})
+}
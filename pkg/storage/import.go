@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ImportOptions change how Import adds entries.
+type ImportOptions struct {
+	// DryRun reports what would be imported without changing anything.
+	DryRun bool
+	// Paths rewrites the directories of the entries before they are added.
+	Paths PathMap
+	// Cursor, when set, is moved to Position along with the entries, see
+	// SetCursor.
+	Cursor   string
+	Position string
+}
+
+// ImportReport sums up an Import.
+type ImportReport struct {
+	Added      int
+	Duplicates int
+	Rewritten  int
+}
+
+func (r ImportReport) String() string {
+	return fmt.Sprintf("%d added, %d duplicates, %d directories rewritten", r.Added, r.Duplicates, r.Rewritten)
+}
+
+// Import adds entries read from elsewhere, such as a shell's history file,
+// all or nothing. Like Merge, an entry of the same command run in the same
+// directory at the same time is a duplicate and is not added again, so a file
+// can be imported more than once. Entries need a directory and a time. The
+// entries added are journaled, to be synced like the ones inserted here.
+func (s *Store) Import(entries []History, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{}
+	for _, history := range entries {
+		if history.DirectoryName == "" {
+			return report, fmt.Errorf("entry %q has no directory", history.Data)
+		}
+		if history.Time.IsZero() {
+			return report, fmt.Errorf("entry %q has no time", history.Data)
+		}
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		merged := MergeReport{}
+		for _, history := range entries {
+			history := history
+			if directory, ok := options.Paths.Rewrite(history.DirectoryName); ok {
+				history.DirectoryName = directory
+				report.Rewritten++
+			}
+			if err := s.mergeEntry(tx, &history, &merged, true); err != nil {
+				return err
+			}
+		}
+		report.Added, report.Duplicates = merged.Added, merged.Duplicates
+		if options.DryRun {
+			return errDryRun
+		}
+		if options.Cursor != "" {
+			return writeCursor(tx, options.Cursor, options.Position)
+		}
+		return nil
+	})
+	if options.DryRun && errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return report, nil
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexBucket orders every entry of every directory by time. Its keys are the
+// entry key, a zero byte and the directory, so entries of different
+// directories never collide, and the values are empty.
+var indexBucket = []byte("index")
+
+func indexKey(key []byte, directory []byte) []byte {
+	indexed := make([]byte, 0, len(key)+1+len(directory))
+	indexed = append(indexed, key...)
+	indexed = append(indexed, 0)
+	return append(indexed, directory...)
+}
+
+// splitIndexKey returns the entry key and directory an index key points to.
+func splitIndexKey(indexed []byte) ([]byte, []byte, error) {
+	separator := bytes.IndexByte(indexed, 0)
+	if separator < 0 {
+		return nil, nil, fmt.Errorf("malformed index key %q", indexed)
+	}
+	return indexed[:separator], indexed[separator+1:], nil
+}
+
+func addToIndex(tx *bolt.Tx, key []byte, directory []byte) error {
+	index, err := tx.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return err
+	}
+	return index.Put(indexKey(key, directory), []byte{})
+}
+
+// lookupIndexed decodes the directory entry an index key points to.
+func lookupIndexed(tx *bolt.Tx, keys *keyring, indexed []byte) (History, error) {
+	key, directory, err := splitIndexKey(indexed)
+	if err != nil {
+		return History{}, err
+	}
+	b := directoryBucket(tx, directory)
+	if b == nil {
+		return History{}, fmt.Errorf("index points to missing directory %s", directory)
+	}
+	value := b.Get(key)
+	if value == nil {
+		return History{}, fmt.Errorf("index points to missing entry %s in %s", key, directory)
+	}
+	return decodeEntry(tx, keys, directory, key, value)
+}
+
+// Between visits the entries of every directory recorded between minTime and
+// maxTime inclusive, oldest first.
+func (s *Store) Between(minTime, maxTime time.Time, handler HistoryHandler) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(indexBucket)
+		if index == nil {
+			return nil
+		}
+		min, max := keyRange(minTime, maxTime)
+		c := index.Cursor()
+		for k, _ := c.Seek(min); k != nil; k, _ = c.Next() {
+			key, _, err := splitIndexKey(k)
+			if err != nil {
+				return err
+			}
+			if bytes.Compare(key, max) > 0 {
+				break
+			}
+			history, err := lookupIndexed(tx, s.keys, k)
+			if err != nil {
+				return err
+			}
+			if err := handler(history); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Latest returns the n most recent entries across all directories, newest first.
+func (s *Store) Latest(numEntries int, filters ...FilterFunction) ([]History, error) {
+	historyList := make([]History, 0, numEntries)
+	filter := applyFilters(filters...)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(indexBucket)
+		if index == nil {
+			return nil
+		}
+		c := index.Cursor()
+		i := numEntries
+		for k, _ := c.Last(); k != nil && i > 0; k, _ = c.Prev() {
+			i--
+			history, err := lookupIndexed(tx, s.keys, k)
+			if err != nil {
+				return err
+			}
+			if filter([]byte(history.DirectoryName), []byte(history.Key), []byte(history.Data)) {
+				historyList = append(historyList, history)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return historyList, nil
+}
+
+// migrateIndex builds the index for entries written before it existed.
+func migrateIndex(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(indexBucket); err != nil {
+		return err
+	}
+	return forEachDirectory(tx, func(name []byte, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if _, _, err := ParseKey(k); err != nil {
+				// Left for fsck, it cannot be placed in time.
+				return nil
+			}
+			return addToIndex(tx, k, name)
+		})
+	})
+}
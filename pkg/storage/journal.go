@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/binary"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// journalBucket lists the entries recorded on this machine, in the order they
+// were added, for sync to pass on to other machines. Entries that came in
+// through sync are not in it, so they are not passed back:
+//
+//	journal  position (8 bytes, big endian) -> entry key, 0, directory
+var journalBucket = []byte("journal")
+
+// A sync server journals the entries pushed to it as well, to hand them out
+// again. It keeps the ids they were pushed with:
+//
+//	origins   position -> change id
+//	received  change id -> empty
+var (
+	originsBucket  = []byte("origins")
+	receivedBucket = []byte("received")
+)
+
+func journalPosition(position uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, position)
+	return key
+}
+
+// appendJournal records that the entry at key in directory was added.
+func appendJournal(tx *bolt.Tx, key []byte, directory []byte) error {
+	journal, err := tx.CreateBucketIfNotExists(journalBucket)
+	if err != nil {
+		return err
+	}
+	position, err := journal.NextSequence()
+	if err != nil {
+		return err
+	}
+	return journal.Put(journalPosition(position), indexKey(key, directory))
+}
+
+// migrateJournal journals the entries written before the journal existed,
+// oldest first, so the first sync passes on the whole history.
+func migrateJournal(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(journalBucket); err != nil {
+		return err
+	}
+	index := tx.Bucket(indexBucket)
+	if index == nil {
+		return nil
+	}
+	return index.ForEach(func(k, v []byte) error {
+		key, directory, err := splitIndexKey(k)
+		if err != nil {
+			// Left for fsck.
+			return nil
+		}
+		return appendJournal(tx, key, directory)
+	})
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// The database file has these top level namespaces:
+//
+//	dirs/<directory>         entry key -> encoded record
+//	annotations/<directory>  entry key -> annotation text
+//	index                    entry key, 0, directory -> empty
+//	commands/<directory>     normalized command -> run count
+//	journal                  position -> entry key, 0, directory
+//	origins, received        change ids of the entries pushed to a sync server
+//	meta                     bookkeeping such as the schema version
+var (
+	dirsBucket        = []byte("dirs")
+	annotationsBucket = []byte("annotations")
+)
+
+// ensureLayout creates the top level namespace buckets.
+func ensureLayout(tx *bolt.Tx) error {
+	for _, name := range [][]byte{dirsBucket, annotationsBucket, indexBucket, commandsBucket, journalBucket, metaBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nestedBucket returns the child bucket of a namespace, or nil if either is missing.
+func nestedBucket(tx *bolt.Tx, namespace []byte, name []byte) *bolt.Bucket {
+	parent := tx.Bucket(namespace)
+	if parent == nil {
+		return nil
+	}
+	return parent.Bucket(name)
+}
+
+func createNestedBucket(tx *bolt.Tx, namespace []byte, name []byte) (*bolt.Bucket, error) {
+	parent, err := tx.CreateBucketIfNotExists(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return parent.CreateBucketIfNotExists(name)
+}
+
+// directoryBucket holds the entries of a directory, nil when there are none.
+func directoryBucket(tx *bolt.Tx, directory []byte) *bolt.Bucket {
+	return nestedBucket(tx, dirsBucket, directory)
+}
+
+// annotationBucket holds the annotations of a directory, nil when there are none.
+func annotationBucket(tx *bolt.Tx, directory []byte) *bolt.Bucket {
+	return nestedBucket(tx, annotationsBucket, directory)
+}
+
+// forEachDirectory visits every directory bucket.
+func forEachDirectory(tx *bolt.Tx, handleBucket bucketHandler) error {
+	return forEachNestedBucket(tx, dirsBucket, handleBucket)
+}
+
+// forEachNestedBucket visits the buckets of a namespace.
+func forEachNestedBucket(tx *bolt.Tx, namespace []byte, handleBucket bucketHandler) error {
+	parent := tx.Bucket(namespace)
+	if parent == nil {
+		return nil
+	}
+	return parent.ForEach(func(name []byte, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		return handleBucket(name, parent.Bucket(name))
+	})
+}
+
+// copyBucket copies every key and nested bucket of src into dst.
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		child, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, src.Bucket(k))
+	})
+}
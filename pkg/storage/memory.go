@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps history in memory only. It is meant for tests and for
+// programs embedding historian that do not want a database file.
+//
+// It is a plain container, not Store without the file: Add keeps every entry
+// as it is given, with no dedup or redaction, and Usage counts the entries it
+// holds rather than every run. Filter out what should not be kept before
+// adding it.
+type MemoryStore struct {
+	mu  sync.RWMutex
+	seq uint64
+	// entries are ordered the same way as the bbolt index: by key, then directory.
+	entries []History
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make([]History, 0, 100),
+	}
+}
+
+func memoryLess(key, directory string, h History) bool {
+	if key != h.Key {
+		return key < h.Key
+	}
+	return directory < h.DirectoryName
+}
+
+// find returns the position of the entry, or where it would be inserted.
+func (m *MemoryStore) find(directory, key string) int {
+	return sort.Search(len(m.entries), func(i int) bool {
+		return !memoryLess(m.entries[i].Key, m.entries[i].DirectoryName, History{Key: key, DirectoryName: directory})
+	})
+}
+
+// Add to storage
+func (m *MemoryStore) Add(history *History) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	history.Key = string(MakeKey(history.Time, m.seq))
+	i := m.find(history.DirectoryName, history.Key)
+	m.entries = append(m.entries, History{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = *history
+	return nil
+}
+
+// Get from storage
+func (m *MemoryStore) Get(directory, key string) (*History, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.find(directory, key)
+	if i == len(m.entries) || m.entries[i].Key != key || m.entries[i].DirectoryName != directory {
+		return nil, fmt.Errorf("no entry %s in %s", key, directory)
+	}
+	history := m.entries[i]
+	return &history, nil
+}
+
+// Delete an entry and its annotation.
+func (m *MemoryStore) Delete(directory, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(directory, key)
+	if i == len(m.entries) || m.entries[i].Key != key || m.entries[i].DirectoryName != directory {
+		return fmt.Errorf("no entry %s in %s", key, directory)
+	}
+	m.entries = append(m.entries[:i], m.entries[i+1:]...)
+	return nil
+}
+
+// Range over storage between dates
+func (m *MemoryStore) Range(directory string, minTime, maxTime time.Time, handler HistoryHandler) error {
+	m.mu.RLock()
+	matches := make([]History, 0, 10)
+	min, max := keyRange(minTime, maxTime)
+	for _, history := range m.entries {
+		if history.Key < string(min) || history.Key > string(max) {
+			continue
+		}
+		if directory == "" || history.DirectoryName == directory {
+			matches = append(matches, history)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, history := range matches {
+		if err := handler(history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Last n entries, newest first.
+func (m *MemoryStore) Last(directory string, numEntries int, filters ...FilterFunction) ([]History, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	historyList := make([]History, 0, numEntries)
+	filter := applyFilters(filters...)
+	found := false
+	i := numEntries
+	for j := len(m.entries) - 1; j >= 0 && i > 0; j-- {
+		history := m.entries[j]
+		if directory != "" && history.DirectoryName != directory {
+			continue
+		}
+		found = true
+		i--
+		if filter([]byte(history.DirectoryName), []byte(history.Key), []byte(history.Data)) {
+			historyList = append(historyList, history)
+		}
+	}
+	if directory != "" && !found && numEntries > 0 {
+		return nil, fmt.Errorf("no such bucket as %s", directory)
+	}
+	return historyList, nil
+}
+
+// Greps applies multple potential regexes to the command history
+func (m *MemoryStore) Greps(regexes ...string) ([]History, error) {
+	filter, err := GrepFilter(regexes...)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	historyList := make([]History, 0, 10)
+	for _, history := range m.entries {
+		if filter([]byte(history.DirectoryName), []byte(history.Key), []byte(history.Data)) {
+			historyList = append(historyList, history)
+		}
+	}
+	return historyList, nil
+}
+
+// Usage counts the entries of each command it holds, most recently used
+// first. Deleting an entry takes it out of the count.
+func (m *MemoryStore) Usage(directory string) ([]Usage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type usageKey struct {
+		directory string
+		command   string
+	}
+	counted := map[usageKey]*Usage{}
+	usages := []*Usage{}
+	for _, history := range m.entries {
+		if directory != "" && history.DirectoryName != directory {
+			continue
+		}
+		key := usageKey{history.DirectoryName, NormalizeCommand(history.Data)}
+		usage, ok := counted[key]
+		if !ok {
+			usage = &Usage{Command: key.command, Directory: key.directory, FirstSeen: history.Time, LastSeen: history.Time}
+			counted[key] = usage
+			usages = append(usages, usage)
+		}
+		usage.Count++
+		if history.Time.Before(usage.FirstSeen) {
+			usage.FirstSeen = history.Time
+		}
+		if history.Time.After(usage.LastSeen) {
+			usage.LastSeen = history.Time
+		}
+	}
+	result := make([]Usage, 0, len(usages))
+	for _, usage := range usages {
+		result = append(result, *usage)
+	}
+	sortUsage(result)
+	return result, nil
+}
+
+// Close does nothing, there is nothing to release.
+func (m *MemoryStore) Close() {}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MergeOptions tune Merge.
+type MergeOptions struct {
+	// Secret unlocks an encrypted source database.
+	Secret *Secret
+	// DryRun reports what would be merged without changing anything.
+	DryRun bool
+	// Paths rewrites the directories of the source, for history recorded on
+	// a machine that keeps its checkouts elsewhere.
+	Paths PathMap
+}
+
+// MergeReport sums up a Merge.
+type MergeReport struct {
+	// Directories is how many directories the source has entries in.
+	Directories int
+	// Added entries were missing from the database.
+	Added int
+	// Duplicates were already in the database: the same command, run in the
+	// same directory at the same time, with the same exit status and context.
+	Duplicates int
+	// Annotations were copied onto duplicates that had none.
+	Annotations int
+	// Skipped entries of the source could not be decoded, see fsck.
+	Skipped int
+	// Rewritten entries had their directory rewritten by the path map.
+	Rewritten int
+}
+
+func (r MergeReport) String() string {
+	report := fmt.Sprintf("%d added, %d duplicates, %d annotations copied, %d skipped, from %d directories",
+		r.Added, r.Duplicates, r.Annotations, r.Skipped, r.Directories)
+	if r.Rewritten > 0 {
+		report += fmt.Sprintf(", %d paths rewritten", r.Rewritten)
+	}
+	return report
+}
+
+// Merge inserts the entries of the database file at path that are missing
+// from the store, along with their annotations, and counts their runs. The
+// file itself is left alone: older schemas are migrated in a copy.
+func (s *Store) Merge(path string, options MergeOptions) (MergeReport, error) {
+	report := MergeReport{}
+	source, err := openMergeSource(path, options.Secret)
+	if err != nil {
+		return report, err
+	}
+	defer source.remove()
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		err := source.db.View(func(sourceTx *bolt.Tx) error {
+			return forEachDirectory(sourceTx, func(name []byte, b *bolt.Bucket) error {
+				report.Directories++
+				return b.ForEach(func(k, v []byte) error {
+					history, err := decodeEntry(sourceTx, source.keys, name, k, v)
+					if err != nil {
+						report.Skipped++
+						return nil
+					}
+					if directory, ok := options.Paths.Rewrite(history.DirectoryName); ok {
+						history.DirectoryName = directory
+						report.Rewritten++
+					}
+					return s.mergeEntry(tx, &history, &report, true)
+				})
+			})
+		})
+		if err == nil && options.DryRun {
+			return errDryRun
+		}
+		return err
+	})
+	if options.DryRun && errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// mergeEntry adds history unless it is a duplicate, in which case only a
+// missing annotation is copied. Journaled entries are passed on by sync.
+func (s *Store) mergeEntry(tx *bolt.Tx, history *History, report *MergeReport, journal bool) error {
+	// Compared after redaction, the stored duplicate was redacted as well.
+	Redact(history, s.redactor)
+	duplicate, err := findDuplicate(tx, s.keys, history)
+	if err != nil {
+		return err
+	}
+	if duplicate == nil {
+		report.Added++
+		if err := countRun(tx, s.keys, history); err != nil {
+			return err
+		}
+		if err := addEntry(tx, s.keys, history); err != nil {
+			return err
+		}
+		if !journal {
+			return nil
+		}
+		return appendJournal(tx, []byte(history.Key), []byte(history.DirectoryName))
+	}
+	report.Duplicates++
+	copied, err := copyAnnotation(tx, s.keys, history, duplicate)
+	if copied {
+		report.Annotations++
+	}
+	return err
+}
+
+// copyAnnotation gives duplicate the annotation of history when it has none,
+// reporting whether it did.
+func copyAnnotation(tx *bolt.Tx, keys *keyring, history, duplicate *History) (bool, error) {
+	if history.Annotation == "" || duplicate.Annotation != "" {
+		return false, nil
+	}
+	directory := []byte(duplicate.DirectoryName)
+	ab, err := createNestedBucket(tx, annotationsBucket, directory)
+	if err != nil {
+		return false, err
+	}
+	key := []byte(duplicate.Key)
+	annotation, err := keys.seal([]byte(history.Annotation), annotationsBucket, directory, key)
+	if err != nil {
+		return false, err
+	}
+	return true, ab.Put(key, annotation)
+}
+
+// findDuplicate looks for the same record as history in its directory: the
+// same command run at the same time, with the same end, exit status and
+// context, see sameRecord. Annotations are left out, mergeEntry copies a
+// missing one over. Keys start with the time, so only the entries of that
+// very nanosecond are decoded.
+func findDuplicate(tx *bolt.Tx, keys *keyring, history *History) (*History, error) {
+	directory := []byte(history.DirectoryName)
+	b := directoryBucket(tx, directory)
+	if b == nil {
+		return nil, nil
+	}
+	prefix := []byte(history.Time.UTC().Format(keyTimeLayout) + "-")
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		existing, err := decodeEntry(tx, keys, directory, k, v)
+		if err != nil {
+			continue
+		}
+		if sameRecord(&existing, history) {
+			return &existing, nil
+		}
+	}
+	return nil, nil
+}
+
+// sameRecord reports whether a and b record the same run of a command. What
+// only one of them knows does not tell them apart: shell history files carry
+// no exit status or context, and inserts made before those were recorded
+// neither. Without context an exit status of 0 means unknown.
+func sameRecord(a, b *History) bool {
+	sameIfKnown := func(x, y string) bool { return x == "" || y == "" || x == y }
+	if a.ExitCode != b.ExitCode && a.hasContext() && b.hasContext() {
+		return false
+	}
+	return a.Data == b.Data &&
+		a.Time.Equal(b.Time) &&
+		(a.EndTime.IsZero() || b.EndTime.IsZero() || a.EndTime.Equal(b.EndTime)) &&
+		(a.ExitCode == 0 || b.ExitCode == 0 || a.ExitCode == b.ExitCode) &&
+		sameIfKnown(a.SessionID, b.SessionID) &&
+		sameIfKnown(a.Hostname, b.Hostname) &&
+		sameIfKnown(a.Username, b.Username) &&
+		sameIfKnown(a.Shell, b.Shell) &&
+		sameIfKnown(a.TTY, b.TTY)
+}
+
+// hasContext reports whether h records where the command ran, which inserts
+// do along with the exit status.
+func (h *History) hasContext() bool {
+	return h.SessionID != "" || h.Hostname != "" || h.Username != "" || h.Shell != "" || h.TTY != ""
+}
+
+// mergeSource is a copy of the database merged from.
+type mergeSource struct {
+	*Store
+	path string
+}
+
+// openMergeSource copies the database file at path, after validating it, and
+// opens the copy.
+func openMergeSource(path string, secret *Secret) (*mergeSource, error) {
+	if _, err := ValidateBackup(path); err != nil {
+		return nil, err
+	}
+	copied, err := ioutil.TempFile("", "historian-merge-*.db")
+	if err != nil {
+		return nil, err
+	}
+	copied.Close()
+	if err := copyFile(copied.Name(), path); err != nil {
+		os.Remove(copied.Name())
+		return nil, err
+	}
+	options := []StoreOption{WithTimeout(time.Second)}
+	if secret != nil {
+		options = append(options, WithSecret(secret))
+	}
+	store, err := NewStore(copied.Name(), options...)
+	if err != nil {
+		os.Remove(copied.Name())
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+	return &mergeSource{Store: store, path: copied.Name()}, nil
+}
+
+func (m *mergeSource) remove() {
+	m.Close()
+	os.Remove(m.path)
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// metaBucket holds bookkeeping about the database file itself.
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schema-version")
+
+	errDryRun = errors.New("dry run")
+)
+
+// Migration upgrades a database file from Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(tx *bolt.Tx) error
+}
+
+// migrations in the order they have to be applied. Files without a meta
+// bucket predate versioning and are version 1.
+var migrations = []Migration{
+	{
+		Version:     2,
+		Description: "unique entry keys and structured entry records",
+		Apply:       migrateRecords,
+	},
+	{
+		Version:     3,
+		Description: "separate dirs, annotations and meta namespaces",
+		Apply:       migrateNamespaces,
+	},
+	{
+		Version:     4,
+		Description: "global chronological index",
+		Apply:       migrateIndex,
+	},
+	{
+		Version:     5,
+		Description: "per directory command run counts",
+		Apply:       migrateUsage,
+	},
+	{
+		Version:     6,
+		Description: "journal of the entries recorded on this machine, for sync",
+		Apply:       migrateJournal,
+	},
+}
+
+// SchemaVersion is the layout version written by this build.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// WithoutMigrations stops NewStore from upgrading an old database file.
+func WithoutMigrations() StoreOption {
+	return func(s *Store) error {
+		s.skipMigrations = true
+		return nil
+	}
+}
+
+func readSchemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		empty := true
+		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			empty = false
+			return nil
+		})
+		if empty {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	version, err := strconv.Atoi(string(meta.Get(schemaVersionKey)))
+	if err != nil {
+		return 0, fmt.Errorf("could not read schema version: %w", err)
+	}
+	return version, nil
+}
+
+func writeSchemaVersion(tx *bolt.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	return meta.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// SchemaVersion of the open database file. A brand new file reports 0.
+func (s *Store) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = readSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// PendingMigrations lists the migrations needed to bring the file up to date.
+func (s *Store) PendingMigrations() ([]Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version)
+}
+
+func pendingMigrations(version int) ([]Migration, error) {
+	if version > SchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", version, SchemaVersion())
+	}
+	pending := []Migration{}
+	if version == 0 {
+		// New files are created with the current layout.
+		return pending, nil
+	}
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations, each one in its own transaction so
+// a failure leaves the file at the last version that succeeded. With dryRun
+// every migration runs inside a single transaction that is rolled back.
+func (s *Store) Migrate(dryRun bool) ([]Migration, error) {
+	var pending []Migration
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		version, err := readSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		pending, err = pendingMigrations(version)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			if dryRun {
+				return errDryRun
+			}
+			if err := ensureLayout(tx); err != nil {
+				return err
+			}
+			return writeSchemaVersion(tx, SchemaVersion())
+		}
+		if !dryRun {
+			return nil
+		}
+		for _, migration := range pending {
+			if err := applyMigration(tx, migration); err != nil {
+				return err
+			}
+		}
+		return errDryRun
+	})
+	if dryRun && errors.Is(err, errDryRun) {
+		return pending, nil
+	}
+	if err != nil || dryRun {
+		return pending, err
+	}
+
+	for _, migration := range pending {
+		logrus.Infof("migrating database to version %d: %s", migration.Version, migration.Description)
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return applyMigration(tx, migration)
+		})
+		if err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
+
+func applyMigration(tx *bolt.Tx, migration Migration) error {
+	err := migration.Apply(tx)
+	if err != nil {
+		return fmt.Errorf("migration to version %d failed: %w", migration.Version, err)
+	}
+	return writeSchemaVersion(tx, migration.Version)
+}
+
+// isMetaBucket reports whether a top level bucket of a version 1 or 2 file
+// holds bookkeeping rather than the history of a directory.
+func isMetaBucket(name []byte) bool {
+	return bytes.Equal(name, metaBucket)
+}
+
+// migrateRecords rekeys version 1 entries (RFC3339 second resolution keys
+// holding the bare command) to sequence keys holding encoded records. The
+// matching annotations move along with their entries.
+func migrateRecords(tx *bolt.Tx) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if isMetaBucket(name) || strings.HasPrefix(string(name), legacyAnnotationPrefix) {
+			return nil
+		}
+		annotations := tx.Bucket([]byte(legacyAnnotationPrefix + string(name)))
+
+		type entry struct {
+			key   []byte
+			value []byte
+		}
+		entries := []entry{}
+		err := b.ForEach(func(k, v []byte) error {
+			entries = append(entries, entry{key: append([]byte{}, k...), value: append([]byte{}, v...)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			timeValue, seq, err := ParseKey(e.key)
+			if err != nil {
+				logrus.Warnf("leaving unparsable key %q in %s", e.key, name)
+				continue
+			}
+			history := History{Time: timeValue}
+			if err := decodeRecord(e.value, &history); err != nil {
+				return err
+			}
+			key := e.key
+			if string(MakeKey(timeValue, seq)) != string(e.key) {
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				key = MakeKey(timeValue, seq)
+			}
+			value, err := encodeRecord(&history)
+			if err != nil {
+				return err
+			}
+			if string(key) != string(e.key) {
+				if err := b.Delete(e.key); err != nil {
+					return err
+				}
+			}
+			if err := b.Put(key, value); err != nil {
+				return err
+			}
+			if annotations == nil || string(key) == string(e.key) {
+				continue
+			}
+			if annotation := annotations.Get(e.key); annotation != nil {
+				annotation = append([]byte{}, annotation...)
+				if err := annotations.Delete(e.key); err != nil {
+					return err
+				}
+				if err := annotations.Put(key, annotation); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// legacyAnnotationPrefix marks the annotation buckets of version 1 and 2
+// files, which sat next to the directory buckets they belong to.
+const legacyAnnotationPrefix = "annotations-"
+
+// migrateNamespaces moves the top level directory and annotations-<dir>
+// buckets into the dirs and annotations namespaces.
+func migrateNamespaces(tx *bolt.Tx) error {
+	names := [][]byte{}
+	err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if isMetaBucket(name) {
+			return nil
+		}
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := ensureLayout(tx); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		namespace, child := dirsBucket, name
+		if bytes.HasPrefix(name, []byte(legacyAnnotationPrefix)) {
+			namespace, child = annotationsBucket, name[len(legacyAnnotationPrefix):]
+		}
+		dst, err := createNestedBucket(tx, namespace, child)
+		if err != nil {
+			return fmt.Errorf("could not move bucket %s: %w", name, err)
+		}
+		if err := copyBucket(dst, tx.Bucket(name)); err != nil {
+			return fmt.Errorf("could not move bucket %s: %w", name, err)
+		}
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
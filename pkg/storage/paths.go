@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// PathRule moves the directories under From to under To.
+type PathRule struct {
+	From string
+	To   string
+}
+
+// ParsePathRule parses "from=to", such as "/Users/alice/src=/home/alice/code".
+func ParsePathRule(spec string) (PathRule, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return PathRule{}, fmt.Errorf("invalid path mapping %q, expected from=to", spec)
+	}
+	return PathRule{From: cleanPrefix(parts[0]), To: cleanPrefix(parts[1])}, nil
+}
+
+// cleanPrefix drops trailing slashes, except from the root.
+func cleanPrefix(prefix string) string {
+	trimmed := strings.TrimRight(prefix, "/")
+	if trimmed == "" {
+		return "/"
+	}
+	return trimmed
+}
+
+// rewrite applies the rule to directory. From only matches whole path
+// components, /src matches /src and /src/foo but not /srcs.
+func (r PathRule) rewrite(directory string) (string, bool) {
+	if directory == r.From {
+		return r.To, true
+	}
+	prefix := r.From
+	if prefix != "/" {
+		prefix += "/"
+	}
+	if !strings.HasPrefix(directory, prefix) {
+		return directory, false
+	}
+	rest := strings.TrimPrefix(directory, prefix)
+	if r.To == "/" {
+		return "/" + rest, true
+	}
+	return r.To + "/" + rest, true
+}
+
+// PathMap is an ordered list of rules, the first rule matching a directory
+// rewrites it.
+type PathMap []PathRule
+
+// ParsePathMap parses every spec with ParsePathRule, keeping their order.
+func ParsePathMap(specs []string) (PathMap, error) {
+	paths := PathMap{}
+	for _, spec := range specs {
+		rule, err := ParsePathRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, rule)
+	}
+	return paths, nil
+}
+
+// Rewrite returns directory rewritten by the first matching rule, and
+// whether any rule matched.
+func (m PathMap) Rewrite(directory string) (string, bool) {
+	for _, rule := range m {
+		if rewritten, ok := rule.rewrite(directory); ok {
+			return rewritten, rewritten != directory
+		}
+	}
+	return directory, false
+}
+
+// PathMove is a directory RewritePaths moved.
+type PathMove struct {
+	From string
+	To   string
+	// Entries were moved, Duplicates were dropped because the same command
+	// ran at the same time in To already. Their annotations are kept when
+	// the entry in To has none.
+	Entries    int
+	Duplicates int
+}
+
+// RewritePaths moves the entries, annotations and run counts of every
+// directory paths rewrites to the rewritten directory, joining the history
+// already there. Moved entries are journaled again, under their new keys, for
+// sync to pass on. Entries that can not be decoded stay where they are, see
+// Fsck. With dryRun nothing is changed.
+func (s *Store) RewritePaths(paths PathMap, dryRun bool) ([]PathMove, error) {
+	moves := []PathMove{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		moves, err = rewritePaths(tx, s.keys, paths)
+		if err == nil && dryRun {
+			return errDryRun
+		}
+		return err
+	})
+	if dryRun && errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+// rewritePaths reads every entry and run count to move before moving any,
+// and takes them all out before adding them back, so what is moved into a
+// directory that is rewritten itself is not moved twice, as with the rules
+// /a=/b and /b=/c.
+func rewritePaths(tx *bolt.Tx, keys *keyring, paths PathMap) ([]PathMove, error) {
+	type planned struct {
+		move    PathMove
+		entries []History
+		usage   []usageRecord
+	}
+	plans := []*planned{}
+	byName := map[string]*planned{}
+	seen := map[string]bool{}
+	plan := func(name []byte) *planned {
+		if seen[string(name)] {
+			return byName[string(name)]
+		}
+		seen[string(name)] = true
+		to, ok := paths.Rewrite(string(name))
+		if !ok {
+			return nil
+		}
+		p := &planned{move: PathMove{From: string(name), To: to}}
+		plans = append(plans, p)
+		byName[string(name)] = p
+		return p
+	}
+	err := forEachDirectory(tx, func(name []byte, b *bolt.Bucket) error {
+		p := plan(name)
+		if p == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			history, err := decodeEntry(tx, keys, name, k, v)
+			if err != nil {
+				// Left for fsck.
+				return nil
+			}
+			p.entries = append(p.entries, history)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Directories may have run counts without entries, when dedup kept them out.
+	err = forEachNestedBucket(tx, commandsBucket, func(name []byte, b *bolt.Bucket) error {
+		p := plan(name)
+		if p == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			value, err := keys.open(v, commandsBucket, name, k)
+			if err != nil {
+				return err
+			}
+			var usage usageRecord
+			if err := json.Unmarshal(value, &usage); err != nil {
+				return err
+			}
+			p.usage = append(p.usage, usage)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range plans {
+		from := []byte(p.move.From)
+		for _, history := range p.entries {
+			if err := deleteEntry(tx, from, []byte(history.Key)); err != nil {
+				return nil, err
+			}
+		}
+		if nestedBucket(tx, commandsBucket, from) != nil {
+			if err := tx.Bucket(commandsBucket).DeleteBucket(from); err != nil {
+				return nil, err
+			}
+		}
+	}
+	moves := []PathMove{}
+	for _, p := range plans {
+		to := []byte(p.move.To)
+		for i := range p.usage {
+			if err := addUsage(tx, keys, to, &p.usage[i]); err != nil {
+				return nil, err
+			}
+		}
+		for _, history := range p.entries {
+			history := history
+			history.DirectoryName = p.move.To
+			duplicate, err := findDuplicate(tx, keys, &history)
+			if err != nil {
+				return nil, err
+			}
+			if duplicate != nil {
+				p.move.Duplicates++
+				if _, err := copyAnnotation(tx, keys, &history, duplicate); err != nil {
+					return nil, err
+				}
+				if err := uncountRun(tx, keys, to, history.Data); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			p.move.Entries++
+			if err := addEntry(tx, keys, &history); err != nil {
+				return nil, err
+			}
+			// The entry left under its old key is no longer found, sync
+			// passes it on under the new one.
+			if err := appendJournal(tx, []byte(history.Key), to); err != nil {
+				return nil, err
+			}
+		}
+		moves = append(moves, p.move)
+	}
+	for _, p := range plans {
+		for _, namespace := range [][]byte{dirsBucket, annotationsBucket} {
+			if err := deleteIfEmpty(tx, namespace, []byte(p.move.From)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return moves, nil
+}
+
+// addUsage adds the run count usage, as kept in another directory, to that of
+// directory.
+func addUsage(tx *bolt.Tx, keys *keyring, directory []byte, usage *usageRecord) error {
+	existing, err := readUsage(tx, keys, directory, usage.Command)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		merged := MergeUsage([]Usage{usage.Usage, existing.Usage})[0]
+		stored := time.Time{}
+		if !usage.Stored.IsZero() || !existing.Stored.IsZero() {
+			stored = usage.storedSince()
+			if existing.storedSince().Before(stored) {
+				stored = existing.storedSince()
+			}
+		}
+		usage = &usageRecord{Usage: merged, Stored: stored}
+	}
+	return writeUsage(tx, keys, directory, usage)
+}
+
+// deleteIfEmpty removes namespace/name when nothing is left in it.
+func deleteIfEmpty(tx *bolt.Tx, namespace, name []byte) error {
+	b := nestedBucket(tx, namespace, name)
+	if b == nil {
+		return nil
+	}
+	if k, _ := b.Cursor().First(); k != nil {
+		return nil
+	}
+	return tx.Bucket(namespace).DeleteBucket(name)
+}
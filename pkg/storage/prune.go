@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var lastPruneKey = []byte("last-prune")
+
+// PrunePolicy selects the entries Prune removes. Directory and Match narrow
+// down the entries considered, of those the ones older than OlderThan or
+// beyond the newest KeepLast of their directory are removed. Without
+// OlderThan and KeepLast every considered entry is removed.
+type PrunePolicy struct {
+	OlderThan time.Duration
+	KeepLast  int
+	Directory string
+	Match     *regexp.Regexp
+}
+
+func (p PrunePolicy) limited() bool {
+	return p.OlderThan > 0 || p.KeepLast > 0
+}
+
+// Prune removes the entries selected by policy along with their annotations,
+// and returns them. With dryRun nothing is removed.
+func (s *Store) Prune(policy PrunePolicy, dryRun bool) ([]History, error) {
+	pruned := []History{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		pruned, err = pruneEntries(tx, s.keys, policy, s.timeFunc())
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		for _, history := range pruned {
+			if err := removeEntry(tx, s.keys, []byte(history.DirectoryName), []byte(history.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if dryRun && errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+// pruneEntries lists the entries policy selects.
+func pruneEntries(tx *bolt.Tx, keys *keyring, policy PrunePolicy, now time.Time) ([]History, error) {
+	pruned := []History{}
+	var cutoff []byte
+	if policy.OlderThan > 0 {
+		cutoff, _ = keyRange(now.Add(-policy.OlderThan), now)
+	}
+	pruneDirectory := func(name []byte, b *bolt.Bucket) error {
+		kept := 0
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			history, err := decodeEntry(tx, keys, name, k, v)
+			if err != nil {
+				// Left for fsck.
+				continue
+			}
+			if policy.Match != nil && !policy.Match.MatchString(history.Data) {
+				continue
+			}
+			remove := !policy.limited()
+			if policy.KeepLast > 0 && kept >= policy.KeepLast {
+				remove = true
+			}
+			if cutoff != nil && string(k) < string(cutoff) {
+				remove = true
+			}
+			if !remove {
+				kept++
+				continue
+			}
+			pruned = append(pruned, history)
+		}
+		return nil
+	}
+	if policy.Directory != "" {
+		b := directoryBucket(tx, []byte(policy.Directory))
+		if b == nil {
+			return pruned, nil
+		}
+		return pruned, pruneDirectory([]byte(policy.Directory), b)
+	}
+	return pruned, forEachDirectory(tx, pruneDirectory)
+}
+
+// AutoPrune prunes with policy unless that already happened within interval.
+// It reports whether it pruned.
+func (s *Store) AutoPrune(policy PrunePolicy, interval time.Duration) (bool, []History, error) {
+	now := s.timeFunc()
+	due := true
+	err := s.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return nil
+		}
+		last := meta.Get(lastPruneKey)
+		if last == nil {
+			return nil
+		}
+		lastPrune, err := time.Parse(time.RFC3339, string(last))
+		if err != nil {
+			return nil
+		}
+		due = now.Sub(lastPrune) >= interval
+		return nil
+	})
+	if err != nil || !due {
+		return false, nil, err
+	}
+	pruned, err := s.Prune(policy, false)
+	if err != nil {
+		return false, nil, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(lastPruneKey, []byte(now.Format(time.RFC3339)))
+	})
+	return true, pruned, err
+}
+
+// WithClock replaces the clock the store uses for "now", for tests.
+func WithClock(now func() time.Time) StoreOption {
+	return func(s *Store) error {
+		s.timeFunc = now
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// recordVersion is the version of the record layout written by encodeRecord.
+const recordVersion = 1
+
+// record is the structure stored as the value of every directory bucket entry.
+// The directory and annotation are not part of it, they live in the bucket
+// name and the annotation bucket respectively.
+type record struct {
+	Version   int       `json:"v"`
+	ID        int64     `json:"id,omitempty"`
+	Command   string    `json:"cmd"`
+	ExitCode  int       `json:"exit"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	SessionID string    `json:"session,omitempty"`
+	Hostname  string    `json:"host,omitempty"`
+	Username  string    `json:"user,omitempty"`
+	Shell     string    `json:"shell,omitempty"`
+	TTY       string    `json:"tty,omitempty"`
+}
+
+// encodeRecord serialises the stored fields of a history entry.
+func encodeRecord(h *History) ([]byte, error) {
+	r := record{
+		Version:   recordVersion,
+		ID:        h.ID,
+		Command:   h.Data,
+		ExitCode:  h.ExitCode,
+		Start:     h.Time,
+		End:       h.EndTime,
+		SessionID: h.SessionID,
+		Hostname:  h.Hostname,
+		Username:  h.Username,
+		Shell:     h.Shell,
+		TTY:       h.TTY,
+	}
+	return json.Marshal(r)
+}
+
+// decodeRecord fills h from a stored value. Values written before records were
+// introduced are the bare command string, and only set the command.
+func decodeRecord(value []byte, h *History) error {
+	var r record
+	if len(value) == 0 || value[0] != '{' || json.Unmarshal(value, &r) != nil || r.Version == 0 {
+		h.Data = string(value)
+		return nil
+	}
+	if r.Version > recordVersion {
+		return fmt.Errorf("unsupported record version %d", r.Version)
+	}
+	h.ID = r.ID
+	h.Data = r.Command
+	h.ExitCode = r.ExitCode
+	if !r.Start.IsZero() {
+		h.Time = r.Start
+	}
+	h.EndTime = r.End
+	h.SessionID = r.SessionID
+	h.Hostname = r.Hostname
+	h.Username = r.Username
+	h.Shell = r.Shell
+	h.TTY = r.TTY
+	return nil
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"github.com/svanellewee/historian/pkg/redact"
+)
+
+// WithRedactor masks the secrets redactor finds in the commands and
+// annotations Add stores.
+func WithRedactor(redactor *redact.Redactor) StoreOption {
+	return func(s *Store) error {
+		s.redactor = redactor
+		return nil
+	}
+}
+
+// Redact masks the secrets in the command and annotation of history, and
+// returns the names of the rules that found any.
+func Redact(history *History, redactor *redact.Redactor) []string {
+	var command, annotation []string
+	history.Data, command = redactor.Redact(history.Data)
+	history.Annotation, annotation = redactor.Redact(history.Annotation)
+	return append(command, annotation...)
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// spoolEntry is one line of the spool file.
+type spoolEntry struct {
+	Directory  string          `json:"dir,omitempty"`
+	Annotation string          `json:"annotation,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	Dedup      DedupMode       `json:"dedup,omitempty"`
+	// Sealed holds the fields above for an encrypted database. The key is
+	// derived from the secret with Params, the database and its parameters
+	// are locked while spooling.
+	Params *encryptionParams `json:"params,omitempty"`
+	Sealed []byte            `json:"sealed,omitempty"`
+}
+
+// spoolLocation is what sealed spool entries are bound to.
+var spoolLocation = []byte("spool")
+
+// AppendToSpool queues an entry in the spool file at path, for when the
+// database is locked. Entries are merged in by DrainSpool, applying mode, or
+// the dedup mode of the store draining them for DedupNone. With a secret, the
+// entry is sealed like the database's values, so an encrypted database does
+// not leave commands in the clear.
+func AppendToSpool(path string, history *History, mode DedupMode, secret *Secret) error {
+	value, err := encodeRecord(history)
+	if err != nil {
+		return err
+	}
+	entry := spoolEntry{
+		Directory:  history.DirectoryName,
+		Annotation: history.Annotation,
+		Record:     value,
+		Dedup:      mode,
+	}
+	if secret != nil {
+		if entry, err = sealSpoolEntry(entry, secret); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// A single write per entry, so concurrent appends do not interleave.
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// DrainSpool adds the entries of the spool file at path to the database in a
+// single transaction and removes the file. It returns how many entries were
+// merged. Lines that are not entries, such as a write cut short, are moved to
+// path.rejected rather than dropped.
+//
+// The spool is first renamed aside, so shells can keep appending to a fresh
+// file while it is drained. Because the database is locked while draining, a
+// spool left aside by an interrupted drain is picked up by the next one.
+func (s *Store) DrainSpool(path string) (int, error) {
+	draining := path + ".draining"
+	if _, err := os.Stat(draining); os.IsNotExist(err) {
+		err = os.Rename(path, draining)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	entries, rejected, err := readSpool(draining, s.secret)
+	if err != nil {
+		return 0, err
+	}
+	if err := rejectSpoolLines(path+".rejected", rejected); err != nil {
+		return 0, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range entries {
+			mode := entry.dedup
+			if mode == DedupNone {
+				mode = s.dedup
+			}
+			if err := s.insert(tx, entry.history, mode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), os.Remove(draining)
+}
+
+func sealSpoolEntry(entry spoolEntry, secret *Secret) (spoolEntry, error) {
+	params, err := newParams(secret)
+	if err != nil {
+		return entry, err
+	}
+	keys, err := deriveKeyring(secret, params)
+	if err != nil {
+		return entry, err
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	sealed, err := keys.seal(value, spoolLocation)
+	if err != nil {
+		return entry, err
+	}
+	return spoolEntry{Params: params, Sealed: sealed}, nil
+}
+
+// openSpoolEntry returns the fields of a sealed entry. The keys derived are
+// kept by salt, entries spooled by the same process share them.
+func openSpoolEntry(entry spoolEntry, secret *Secret, keys map[string]*keyring) (spoolEntry, error) {
+	if secret == nil {
+		return entry, ErrEncrypted
+	}
+	salt := string(entry.Params.Salt)
+	if keys[salt] == nil {
+		derived, err := deriveKeyring(secret, entry.Params)
+		if err != nil {
+			return entry, err
+		}
+		keys[salt] = derived
+	}
+	value, err := keys[salt].open(entry.Sealed, spoolLocation)
+	if err != nil {
+		return entry, ErrWrongSecret
+	}
+	var opened spoolEntry
+	if err := json.Unmarshal(value, &opened); err != nil {
+		return entry, err
+	}
+	return opened, nil
+}
+
+// spooledEntry is an entry read back from the spool.
+type spooledEntry struct {
+	history *History
+	dedup   DedupMode
+}
+
+// rejectedLine is a line of the spool that could not be read.
+type rejectedLine struct {
+	number int
+	text   []byte
+	err    error
+}
+
+// readSpool returns the entries of the spool file at path, and the lines that
+// are not entries. Sealed entries that do not open are an error instead, they
+// need the right secret rather than to be put aside.
+func readSpool(path string, secret *Secret) ([]spooledEntry, []rejectedLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	entries := []spooledEntry{}
+	rejected := []rejectedLine{}
+	keys := map[string]*keyring{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		reject := func(err error) {
+			text := append([]byte{}, scanner.Bytes()...)
+			rejected = append(rejected, rejectedLine{number: line, text: text, err: err})
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely a write cut short, the rest of the spool is still good.
+			reject(err)
+			continue
+		}
+		if entry.Params != nil {
+			opened, err := openSpoolEntry(entry, secret, keys)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			entry = opened
+		}
+		history := &History{
+			DirectoryName: entry.Directory,
+			Annotation:    entry.Annotation,
+		}
+		if err := decodeRecord(entry.Record, history); err != nil {
+			reject(err)
+			continue
+		}
+		entries = append(entries, spooledEntry{history: history, dedup: entry.Dedup})
+	}
+	return entries, rejected, scanner.Err()
+}
+
+// rejectSpoolLines appends the lines to the file at path, for a closer look.
+func rejectSpoolLines(path string, lines []rejectedLine) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		logrus.Warnf("moving line %d of the spool to %s: %v", line.number, path, line.err)
+		if _, err := f.Write(append(line.text, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -2,14 +2,19 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"os/user"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/svanellewee/historian/pkg/redact"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -21,6 +26,16 @@ type History struct {
 	Time          time.Time
 	DirectoryName string
 	Annotation    string
+	// Key is the bucket key the entry is stored under, set by Add and the readers.
+	Key string
+	// Time is when the command started, EndTime when it finished (if known).
+	EndTime   time.Time
+	ExitCode  int
+	SessionID string
+	Hostname  string
+	Username  string
+	Shell     string
+	TTY       string
 }
 
 // HistOption updates History structs.
@@ -54,17 +69,89 @@ func SetAnnotation(annotation string) HistOption {
 	}
 }
 
+func SetEndTime(t time.Time) HistOption {
+	return func(h *History) error {
+		h.EndTime = t
+		return nil
+	}
+}
+
+func SetExitCode(code int) HistOption {
+	return func(h *History) error {
+		h.ExitCode = code
+		return nil
+	}
+}
+
+func SetSession(session string) HistOption {
+	return func(h *History) error {
+		h.SessionID = session
+		return nil
+	}
+}
+
+func SetHostname(hostname string) HistOption {
+	return func(h *History) error {
+		h.Hostname = hostname
+		return nil
+	}
+}
+
+func SetUsername(username string) HistOption {
+	return func(h *History) error {
+		h.Username = username
+		return nil
+	}
+}
+
+func SetShell(shell string) HistOption {
+	return func(h *History) error {
+		h.Shell = shell
+		return nil
+	}
+}
+
+func SetTTY(tty string) HistOption {
+	return func(h *History) error {
+		h.TTY = tty
+		return nil
+	}
+}
+
+// currentUsername falls back to $USER when the user database is unavailable.
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// currentShell is the name of the login shell, ie "bash" for /bin/bash.
+func currentShell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		return ""
+	}
+	return filepath.Base(shell)
+}
+
 // NewHistory returns a new history entry
 func NewHistory(command string, options ...HistOption) (*History, error) {
 	currentDirectory, err := os.Getwd()
 	if err != nil {
 		return nil, err
 	}
+	hostname, _ := os.Hostname()
 
 	history := &History{
 		Time:          time.Now(), // default to current time.
 		DirectoryName: currentDirectory,
 		Data:          command,
+		Hostname:      hostname,
+		Username:      currentUsername(),
+		Shell:         currentShell(),
+		TTY:           os.Getenv("TTY"),
+		SessionID:     os.Getenv("HISTORIAN_SESSION"),
 	}
 
 	for _, option := range options {
@@ -163,15 +250,57 @@ func ConvertOpt(input string) (HistOption, error) {
 	}, nil
 }
 
+// Duration of the command, zero when the end time was not recorded.
+func (h History) Duration() time.Duration {
+	if h.EndTime.IsZero() || h.EndTime.Before(h.Time) {
+		return 0
+	}
+	return h.EndTime.Sub(h.Time)
+}
+
 func (h History) String() string {
 	return fmt.Sprintf("[%s] %s (%s) /*%s*/", h.Time.Format(time.RFC3339), h.Data, h.DirectoryName, h.Annotation)
 }
 
+// Details is String with whichever of the recorded context fields are set.
+func (h History) Details() string {
+	var b strings.Builder
+	b.WriteString(h.String())
+	if !h.EndTime.IsZero() || h.ExitCode != 0 {
+		fmt.Fprintf(&b, " exit=%d", h.ExitCode)
+	}
+	if d := h.Duration(); d > 0 {
+		fmt.Fprintf(&b, " took=%s", d)
+	}
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"user", h.Username},
+		{"host", h.Hostname},
+		{"shell", h.Shell},
+		{"tty", h.TTY},
+		{"session", h.SessionID},
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Fprintf(&b, " %s=%s", field.name, field.value)
+		}
+	}
+	return b.String()
+}
+
 // Store bolddb structure
 type Store struct {
-	db            *bolt.DB
-	directoryFunc func() (string, error)
-	timeFunc      func() time.Time
+	db             *bolt.DB
+	directoryFunc  func() (string, error)
+	timeFunc       func() time.Time
+	skipMigrations bool
+	openTimeout    time.Duration
+	dedup          DedupMode
+	secret         *Secret
+	keys           *keyring
+	redactor       *redact.Redactor
 }
 
 // Close on stores
@@ -208,117 +337,338 @@ var defaultStoreOptions = []StoreOption{
 	defaultStoreCwd,
 }
 
+// ErrLocked is returned by NewStore when another process kept the database
+// locked for longer than the open timeout.
+var ErrLocked = errors.New("database is locked by another process")
+
+// WithTimeout limits how long NewStore waits for another process to release
+// the database. By default it waits indefinitely.
+func WithTimeout(timeout time.Duration) StoreOption {
+	return func(s *Store) error {
+		s.openTimeout = timeout
+		return nil
+	}
+}
+
 // NewStore to create a storage file
 func NewStore(dbFile string, options ...StoreOption) (*Store, error) {
-	db, err := bolt.Open(dbFile, 0777, nil)
+	store := &Store{}
+	for _, defaultOpt := range defaultStoreOptions {
+		defaultOpt(store)
+	}
+	for _, option := range options {
+		if err := option(store); err != nil {
+			return nil, err
+		}
+	}
+	err := store.open(dbFile)
+	if errors.Is(err, ErrLocked) {
+		return nil, err
+	}
 	if err != nil {
 		logrus.Errorf("could not open (%s) [%v]", dbFile, err)
 		return nil, err
 	}
-	store := &Store{
-		db: db,
-	}
-	for _, defaultOpt := range defaultStoreOptions {
-		defaultOpt(store)
+	if !store.skipMigrations {
+		_, err = store.Migrate(false)
+		if err != nil {
+			store.db.Close()
+			return nil, fmt.Errorf("could not migrate (%s): %w", dbFile, err)
+		}
 	}
-	for _, option := range options {
-		option(store)
+	if err := store.unlock(); err != nil {
+		store.db.Close()
+		return nil, err
 	}
 	return store, nil
 }
 
-// Add to storage
-func (s *Store) Add(history *History) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(history.DirectoryName))
+// open opens the bbolt file. When the file was replaced while waiting for the
+// lock, by Compact or Restore, the lock is on the old file and the new one is
+// opened instead.
+func (s *Store) open(dbFile string) error {
+	for {
+		before, statErr := os.Stat(dbFile)
+		db, err := bolt.Open(dbFile, 0777, &bolt.Options{Timeout: s.openTimeout})
+		if errors.Is(err, bolt.ErrTimeout) {
+			return ErrLocked
+		}
 		if err != nil {
 			return err
 		}
-		ts := []byte(TimeToString(history.Time))
-		err = b.Put(ts, []byte(history.Data))
+		after, err := os.Stat(dbFile)
 		if err != nil {
+			db.Close()
 			return err
 		}
+		if statErr == nil && !os.SameFile(before, after) {
+			db.Close()
+			continue
+		}
+		s.db = db
 		return nil
+	}
+}
+
+// Add to storage, counting the run and applying the dedup mode.
+func (s *Store) Add(history *History) error {
+	return s.AddDeduped(history, s.dedup)
+}
+
+// AddDeduped adds history like Add, applying mode rather than the dedup mode
+// the store was opened with.
+func (s *Store) AddDeduped(history *History, mode DedupMode) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.insert(tx, history, mode)
 	})
+}
+
+func (s *Store) insert(tx *bolt.Tx, history *History, mode DedupMode) error {
+	Redact(history, s.redactor)
+	previous, err := dedupEntry(tx, s.keys, mode, history)
+	if err != nil {
+		return err
+	}
+	if err := countRun(tx, s.keys, history); err != nil {
+		return err
+	}
+	if previous != nil {
+		history.Key = string(previous)
+		return nil
+	}
+	if err := addEntry(tx, s.keys, history); err != nil {
+		return err
+	}
+	return appendJournal(tx, []byte(history.Key), []byte(history.DirectoryName))
+}
+
+func addEntry(tx *bolt.Tx, keys *keyring, history *History) error {
+	b, err := createNestedBucket(tx, dirsBucket, []byte(history.DirectoryName))
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := MakeKey(history.Time, seq)
+	value, err := encodeRecord(history)
+	if err != nil {
+		return err
+	}
+	value, err = keys.seal(value, dirsBucket, []byte(history.DirectoryName), key)
+	if err != nil {
+		return err
+	}
+	err = b.Put(key, value)
+	if err != nil {
+		return err
+	}
+	err = addToIndex(tx, key, []byte(history.DirectoryName))
 	if err != nil {
 		return err
 	}
 	if len(history.Annotation) != 0 {
-		err = s.db.Update(func(tx *bolt.Tx) error {
-			b, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("annotations-%s", history.DirectoryName)))
-			if err != nil {
-				return err
-			}
-			ts := []byte(TimeToString(history.Time))
-			err = b.Put(ts, []byte(history.Annotation))
-			if err != nil {
-				return err
-			}
-			return nil
-		})
+		ab, err := createNestedBucket(tx, annotationsBucket, []byte(history.DirectoryName))
+		if err != nil {
+			return fmt.Errorf("could not add annotation for history: %w", err)
+		}
+		annotation, err := keys.seal([]byte(history.Annotation), annotationsBucket, []byte(history.DirectoryName), key)
+		if err != nil {
+			return err
+		}
+		err = ab.Put(key, annotation)
 		if err != nil {
 			return fmt.Errorf("could not add annotation for history: %w", err)
 		}
 	}
-
+	history.Key = string(key)
 	return nil
 }
 
 // Get from storage
 func (s *Store) Get(bucket, key string) (*History, error) {
-	var result []byte
+	var history History
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		result = b.Get([]byte(key))
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	var annotation []byte
-	err = s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(fmt.Sprintf("annotations-%s", bucket)))
+		b := directoryBucket(tx, []byte(bucket))
 		if b == nil {
-			return nil
+			return fmt.Errorf("no such bucket as %s", bucket)
 		}
-		annotation = b.Get([]byte(key))
-		return nil
+		value := b.Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("no entry %s in %s", key, bucket)
+		}
+		var err error
+		history, err = decodeEntry(tx, s.keys, []byte(bucket), []byte(key), value)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &History{
-		Data:       string(result),
-		Annotation: string(annotation),
-	}, nil
+	return &history, nil
 }
 
-// Range over storage between dates
-func (s *Store) Range(bucket string, minTime, maxTime time.Time, handler func(t time.Time, data []byte)) {
-	s.db.View(func(tx *bolt.Tx) error {
-		mainBucket := tx.Bucket([]byte(bucket))
+// decodeEntry builds the History for a directory bucket entry, including its annotation.
+func decodeEntry(tx *bolt.Tx, keys *keyring, directory []byte, key []byte, value []byte) (History, error) {
+	timeValue, _, err := ParseKey(key)
+	if err != nil {
+		return History{}, err
+	}
+	history := History{
+		Time:          timeValue,
+		DirectoryName: string(directory),
+		Key:           string(key),
+	}
+	value, err = keys.open(value, dirsBucket, directory, key)
+	if err != nil {
+		return History{}, fmt.Errorf("could not decode %s in %s: %w", key, directory, err)
+	}
+	err = decodeRecord(value, &history)
+	if err != nil {
+		return History{}, fmt.Errorf("could not decode %s in %s: %w", key, directory, err)
+	}
+	if annotations := annotationBucket(tx, directory); annotations != nil {
+		if annotation := annotations.Get(key); annotation != nil {
+			annotation, err = keys.open(annotation, annotationsBucket, directory, key)
+			if err != nil {
+				return History{}, fmt.Errorf("could not decode annotation %s in %s: %w", key, directory, err)
+			}
+			history.Annotation = string(annotation)
+		}
+	}
+	return history, nil
+}
+
+// Range over storage between dates. An empty directory ranges over every
+// directory, see Between.
+func (s *Store) Range(directory string, minTime, maxTime time.Time, handler HistoryHandler) error {
+	if directory == "" {
+		return s.Between(minTime, maxTime, handler)
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		mainBucket := directoryBucket(tx, []byte(directory))
+		if mainBucket == nil {
+			return nil
+		}
 		c := mainBucket.Cursor()
-		min := []byte(TimeToString(minTime))
-		max := []byte(TimeToString(maxTime))
+		min, max := keyRange(minTime, maxTime)
 		for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
-			tt, err := StringToTime(string(k))
+			history, err := decodeEntry(tx, s.keys, []byte(directory), k, v)
 			if err != nil {
 				return err
 			}
-			handler(tt, v)
+			if err := handler(history); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 }
 
+// Update rewrites the entry history.Key of history.DirectoryName with the
+// command, annotation and other fields of history. Its run is counted for the
+// new command instead of the old one.
+func (s *Store) Update(history *History) error {
+	directory, key := []byte(history.DirectoryName), []byte(history.Key)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := directoryBucket(tx, directory)
+		if b == nil || b.Get(key) == nil {
+			return fmt.Errorf("no entry %s in %s", key, directory)
+		}
+		previous, err := decodeEntry(tx, s.keys, directory, key, b.Get(key))
+		if err != nil {
+			return err
+		}
+		if err := uncountRun(tx, s.keys, directory, previous.Data); err != nil {
+			return err
+		}
+		if err := countRun(tx, s.keys, history); err != nil {
+			return err
+		}
+		value, err := encodeRecord(history)
+		if err != nil {
+			return err
+		}
+		value, err = s.keys.seal(value, dirsBucket, directory, key)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, value); err != nil {
+			return err
+		}
+		if history.Annotation == "" {
+			if annotations := annotationBucket(tx, directory); annotations != nil {
+				return annotations.Delete(key)
+			}
+			return nil
+		}
+		annotations, err := createNestedBucket(tx, annotationsBucket, directory)
+		if err != nil {
+			return err
+		}
+		annotation, err := s.keys.seal([]byte(history.Annotation), annotationsBucket, directory, key)
+		if err != nil {
+			return err
+		}
+		return annotations.Put(key, annotation)
+	})
+}
+
+// Delete an entry along with its annotation, index entry and run count.
+func (s *Store) Delete(directory, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return removeEntry(tx, s.keys, []byte(directory), []byte(key))
+	})
+}
+
+// removeEntry deletes an entry and takes back its run.
+func removeEntry(tx *bolt.Tx, keys *keyring, directory []byte, key []byte) error {
+	var command string
+	if b := directoryBucket(tx, directory); b != nil {
+		if value := b.Get(key); value != nil {
+			value, err := keys.open(value, dirsBucket, directory, key)
+			if err != nil {
+				return err
+			}
+			var history History
+			if err := decodeRecord(value, &history); err != nil {
+				return err
+			}
+			command = history.Data
+		}
+	}
+	if err := deleteEntry(tx, directory, key); err != nil {
+		return err
+	}
+	return uncountRun(tx, keys, directory, command)
+}
+
+func deleteEntry(tx *bolt.Tx, directory []byte, key []byte) error {
+	b := directoryBucket(tx, directory)
+	if b == nil || b.Get(key) == nil {
+		return fmt.Errorf("no entry %s in %s", key, directory)
+	}
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	if annotations := annotationBucket(tx, directory); annotations != nil {
+		if err := annotations.Delete(key); err != nil {
+			return err
+		}
+	}
+	if index := tx.Bucket(indexBucket); index != nil {
+		return index.Delete(indexKey(key, directory))
+	}
+	return nil
+}
+
 type bucketHandler func(name []byte, b *bolt.Bucket) error
 
 // ForEachBucket apply a specified handler function
 func (s *Store) ForEachBucket(handleBucket bucketHandler) error {
 	return s.db.View(func(tx *bolt.Tx) error {
 		// Assume bucket exists and has keys
-		err := tx.ForEach(handleBucket)
+		err := forEachDirectory(tx, handleBucket)
 		if err != nil {
 			return err
 		}
@@ -329,37 +679,21 @@ func (s *Store) ForEachBucket(handleBucket bucketHandler) error {
 // All entries dumped, with optional filter
 func (s *Store) All(filters ...FilterFunction) ([]History, error) {
 	history := make([]History, 0, 1000)
-	filter := func(bucketName []byte, key []byte, value []byte) bool {
-		result := true
-		for _, filterFunction := range filters {
-			result = filterFunction(bucketName, key, value) && result
-			if !result {
-				break
-			}
-		}
-		return result
-	}
-	err := s.ForEachBucket(func(name []byte, b *bolt.Bucket) error {
-		if b != nil {
-			b.ForEach(func(k, v []byte) error {
-				keep := filter(name, k, v)
-				if !keep {
-					return nil
-				}
-				snapshotTime, err := StringToTime(string(k))
+	filter := applyFilters(filters...)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return forEachDirectory(tx, func(name []byte, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				result, err := decodeEntry(tx, s.keys, name, k, v)
 				if err != nil {
 					return err
 				}
-				result := History{
-					Time:          snapshotTime,
-					Data:          string(v),
-					DirectoryName: string(name),
+				if !filter(name, k, []byte(result.Data)) {
+					return nil
 				}
 				history = append(history, result)
 				return nil
 			})
-		}
-		return nil
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -367,13 +701,18 @@ func (s *Store) All(filters ...FilterFunction) ([]History, error) {
 	return history, nil
 }
 
-type bucketKeyValueHandler func(name []byte, bucket *bolt.Bucket, key []byte, value []byte) error
+// HistoryHandler is called with each entry a query visits.
+type HistoryHandler func(h History) error
 
-func oneBucketForDay(name []byte, bucket *bolt.Bucket, timestamp time.Time, handleKeyValue bucketKeyValueHandler) error {
+func oneBucketForDay(tx *bolt.Tx, keys *keyring, name []byte, bucket *bolt.Bucket, timestamp time.Time, handler HistoryHandler) error {
 	c := bucket.Cursor()
-	prefix := makePrefixKeyDate(timestamp)
-	for key, value := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = c.Next() {
-		err := handleKeyValue(name, bucket, key, value)
+	min, max := dayKeyRange(timestamp)
+	for key, value := c.Seek(min); key != nil && bytes.Compare(key, max) <= 0; key, value = c.Next() {
+		history, err := decodeEntry(tx, keys, name, key, value)
+		if err != nil {
+			return err
+		}
+		err = handler(history)
 		if err != nil {
 			return err
 		}
@@ -383,54 +722,68 @@ func oneBucketForDay(name []byte, bucket *bolt.Bucket, timestamp time.Time, hand
 
 // Greps applies multple potential regexes to the command history
 func (s *Store) Greps(regexes ...string) ([]History, error) {
-	filter := func(bucketName []byte, key []byte, value []byte) bool {
-		result := false
-		for _, regex := range regexes {
-			re, err := regexp.Compile(regex)
-			if err != nil {
+	filter, err := GrepFilter(regexes...)
+	if err != nil {
+		return nil, err
+	}
+	return s.All(filter)
+}
+
+// GrepFilter matches commands that match every one of the regexes.
+func GrepFilter(regexes ...string) (FilterFunction, error) {
+	compiled := make([]*regexp.Regexp, 0, len(regexes))
+	for _, regex := range regexes {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return func(bucketName []byte, key []byte, value []byte) bool {
+		for _, re := range compiled {
+			if !re.Match(value) {
 				return false
 			}
-			match := re.Find(value)
-			if len(match) > 0 {
-				result = true
-				continue
-			} else {
-				result = false
-				break
-			}
 		}
-		return result
-	}
-	return s.All(filter)
+		return true
+	}, nil
 }
 
-// AllBucketsForDay something something...also does a today function
-func (s *Store) AllBucketsForDay(requestedTime time.Time, handler bucketKeyValueHandler) error {
-	return s.ForEachBucket(func(name []byte, b *bolt.Bucket) error {
-		return oneBucketForDay(name, b, requestedTime, handler)
-	})
+// AllBucketsForDay visits the entries of every directory recorded on the
+// calendar day of requestedTime, oldest first.
+func (s *Store) AllBucketsForDay(requestedTime time.Time, handler HistoryHandler) error {
+	bod, eod := DayBounds(requestedTime)
+	return s.Between(bod, eod, handler)
 }
 
-func makePrefixKeyDate(timestamp time.Time) []byte {
+// dayKeyRange returns the first and last possible keys for the calendar day of
+// timestamp, in timestamp's own location.
+func dayKeyRange(timestamp time.Time) ([]byte, []byte) {
+	bod, eod := DayBounds(timestamp)
+	return keyRange(bod, eod)
+}
+
+// DayBounds returns the first and last instant of the calendar day of
+// timestamp, in timestamp's own location.
+func DayBounds(timestamp time.Time) (time.Time, time.Time) {
 	year, month, day := timestamp.Date()
-	bod := time.Date(year, month, day, 0, 0, 0, 0, &time.Location{})
-	return []byte(TimeToString(bod)[:10])
+	bod := time.Date(year, month, day, 0, 0, 0, 0, timestamp.Location())
+	return bod, bod.AddDate(0, 0, 1).Add(-time.Nanosecond)
 }
 
 // Today gets the bucket entries for specified date
-func (s *Store) Today(bucket string, prefixTime time.Time, handler func(string, []byte)) {
-	s.db.View(func(tx *bolt.Tx) error {
-		mainBucket := tx.Bucket([]byte(bucket))
-		c := mainBucket.Cursor()
-		prefix := makePrefixKeyDate(prefixTime)
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			handler(string(prefix), v)
+func (s *Store) Today(bucket string, prefixTime time.Time, handler HistoryHandler) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		mainBucket := directoryBucket(tx, []byte(bucket))
+		if mainBucket == nil {
+			return nil
 		}
-		return nil
+		return oneBucketForDay(tx, s.keys, []byte(bucket), mainBucket, prefixTime, handler)
 	})
 }
 
-// FilterFunction provides a type for callback functional options
+// FilterFunction provides a type for callback functional options. The value
+// passed to it is the decoded command.
 type FilterFunction func(bucketName []byte, key []byte, value []byte) bool
 
 func applyFilters(filters ...FilterFunction) FilterFunction {
@@ -443,11 +796,15 @@ func applyFilters(filters ...FilterFunction) FilterFunction {
 	}
 }
 
-// Last n entries
+// Last n entries, newest first. An empty directory returns the last entries
+// across every directory, see Latest.
 func (s *Store) Last(directory string, numEntries int, filters ...FilterFunction) ([]History, error) {
+	if directory == "" {
+		return s.Latest(numEntries, filters...)
+	}
 	historyList := make([]History, 0, numEntries)
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(directory))
+		b := directoryBucket(tx, []byte(directory))
 		if b == nil {
 			return fmt.Errorf("no such bucket as %s", directory)
 		}
@@ -458,22 +815,12 @@ func (s *Store) Last(directory string, numEntries int, filters ...FilterFunction
 			if i <= 0 {
 				break
 			}
-			keep := filter([]byte(directory), k, v)
+			historyValue, err := decodeEntry(tx, s.keys, []byte(directory), k, v)
+			if err != nil {
+				return err
+			}
+			keep := filter([]byte(directory), k, []byte(historyValue.Data))
 			if keep {
-				timeValue, err := time.Parse(time.RFC3339, string(k))
-				if err != nil {
-					return err
-				}
-				annotationBucket := tx.Bucket([]byte(fmt.Sprintf("annotations-%s", directory)))
-				var annotation string
-				if annotationBucket != nil {
-					annotation = string(annotationBucket.Get(k))
-				}
-				historyValue := History{
-					Data:       string(v),
-					Time:       timeValue,
-					Annotation: annotation,
-				}
 				historyList = append(historyList, historyValue)
 			}
 			i--
@@ -495,3 +842,41 @@ func TimeToString(t time.Time) string {
 func StringToTime(s string) (time.Time, error) {
 	return time.Parse(time.RFC3339, s)
 }
+
+// keyTimeLayout is a fixed width UTC timestamp, so keys sort lexically in time order.
+const keyTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// MakeKey builds the bucket key for an entry recorded at t. The sequence
+// number keeps entries recorded within the same nanosecond apart.
+func MakeKey(t time.Time, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s-%016x", t.UTC().Format(keyTimeLayout), seq))
+}
+
+// ParseKey returns the time and sequence number encoded in a bucket key.
+// Keys written before sequence numbers were introduced are plain RFC3339
+// timestamps and are returned with a zero sequence.
+func ParseKey(key []byte) (time.Time, uint64, error) {
+	s := string(key)
+	if len(s) != len(keyTimeLayout)+17 || s[len(keyTimeLayout)] != '-' {
+		t, err := StringToTime(s)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("could not parse key %q: %w", s, err)
+		}
+		return t, 0, nil
+	}
+	t, err := time.Parse(keyTimeLayout, s[:len(keyTimeLayout)])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("could not parse key %q: %w", s, err)
+	}
+	seq, err := strconv.ParseUint(s[len(keyTimeLayout)+1:], 16, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("could not parse key %q: %w", s, err)
+	}
+	return t, seq, nil
+}
+
+// keyRange returns the smallest and largest keys that can hold entries
+// recorded between minTime and maxTime inclusive.
+func keyRange(minTime, maxTime time.Time) ([]byte, []byte) {
+	return []byte(minTime.UTC().Format(keyTimeLayout)), MakeKey(maxTime, math.MaxUint64)
+}
@@ -1,13 +1,19 @@
 package storage_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/historian/pkg/redact"
 	"github.com/svanellewee/historian/pkg/storage"
 	bolt "go.etcd.io/bbolt"
 )
@@ -61,11 +67,8 @@ func TestConvertHelper(t *testing.T) {
 		// 			annotation: "test",
 		// 		},
 	}
-	dbFile := "my.db"
-
-	store, err := storage.NewStore(dbFile)
+	store, err := newTestStore(t)
 	assert.Nil(t, err)
-	defer os.Remove(dbFile)
 
 	for _, testCase := range testCases {
 		history, err := storage.Convert(testCase.command)
@@ -82,11 +85,8 @@ func TestConvertHelper(t *testing.T) {
 }
 
 func TestBucketList(t *testing.T) {
-	dbFile := "my.db"
-
-	store, err := storage.NewStore(dbFile)
+	store, err := newTestStore(t)
 	assert.Nil(t, err)
-	defer os.Remove(dbFile)
 
 	testCases := []struct {
 		directory  string
@@ -152,93 +152,9 @@ func TestBucketList(t *testing.T) {
 
 }
 
-func TestFilter(t *testing.T) {
-	dbFile := "my.db"
-
-	store, err := storage.NewStore(dbFile)
-	assert.Nil(t, err)
-	defer os.Remove(dbFile)
-	timestamp1 := time.Date(2020, 1, 1, 0, 0, 0, 0, &time.Location{})
-	fmt.Println(timestamp1.Format(time.RFC3339), "......!")
-	data := []struct {
-		directory string
-		timestamp time.Time
-		command   string
-	}{
-		{
-			directory: "/tmp",
-			timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, &time.Location{}),
-			command:   "echo hello world",
-		},
-		{
-			directory: "/dir1",
-			timestamp: time.Date(2020, 1, 1, 23, 55, 55, 55, &time.Location{}),
-			command:   "echo bye world",
-		},
-		{
-			directory: "/dir2",
-			timestamp: time.Date(2020, 1, 2, 1, 0, 2, 0, &time.Location{}),
-			command:   "printf '%s..' bye",
-		},
-		{
-			directory: "/home/user",
-			timestamp: time.Date(2020, 1, 1, 1, 1, 2, 0, &time.Location{}),
-			command:   "printf 'sneaky %s' hello",
-		},
-		{
-			directory: "/home/user2",
-			timestamp: time.Date(2020, 1, 2, 1, 2, 2, 0, &time.Location{}),
-			command: `cat<<"EOF" > test
-			bla hello
-			EOF
-			`,
-		},
-	}
-
-	for _, datum := range data {
-		history, err := storage.NewHistory(
-			datum.command,
-			storage.SetDirectory(datum.directory),
-			storage.SetTime(datum.timestamp),
-		)
-		assert.Nil(t, err)
-		err = store.Add(history)
-		assert.Nil(t, err)
-	}
-
-	testCases := []struct {
-		matches    []string
-		matchCount int
-	}{
-		{
-			matches:    []string{"hello"},
-			matchCount: 3,
-		},
-		{
-			matches: []string{
-				"hello", "world",
-			},
-			matchCount: 1,
-		},
-	}
-
-	for _, testCase := range testCases {
-		history, err := store.Greps(testCase.matches...)
-		assert.Nil(t, err)
-		fmt.Printf("HISTORY LENGTH::: %d \n", len(history))
-		for _, h := range history {
-			fmt.Printf("----> %s\n", h)
-		}
-		assert.Equal(t, testCase.matchCount, len(history))
-	}
-}
-
 func TestAnother(t *testing.T) {
-	dbFile := "my.db"
-
-	store, err := storage.NewStore(dbFile)
+	store, err := newTestStore(t)
 	assert.Nil(t, err)
-	defer os.Remove(dbFile)
 	timestamp1 := time.Date(2020, 1, 1, 0, 0, 0, 0, &time.Location{})
 	fmt.Println(timestamp1.Format(time.RFC3339), "......!")
 	testCases := []struct {
@@ -294,25 +210,32 @@ func TestAnother(t *testing.T) {
 
 	fmt.Println("\nRange test..")
 	rangeCount := 0
-	store.Range("/tmp", minTime, maxTime, func(t time.Time, value []byte) {
+	err = store.Range("/tmp", minTime, maxTime, func(h storage.History) error {
 		rangeCount += 1
-		fmt.Printf("RANGE  [%s]: %s\n", t.Format(time.RFC3339), value)
+		fmt.Printf("RANGE  [%s]: %s\n", h.Time.Format(time.RFC3339), h.Data)
+		return nil
 	})
+	assert.Nil(t, err)
 	assert.Equal(t, 3, rangeCount)
 
 	fmt.Println("\nPrefix test")
 	prefixCount := 0
-	store.Today("/tmp", minTime, func(k string, v []byte) {
+	err = store.Today("/tmp", minTime, func(h storage.History) error {
 		prefixCount += 1
-		fmt.Printf("PREFIX key=%s, value=%s\n", k, v)
+		fmt.Printf("PREFIX key=%s, value=%s\n", h.Key, h.Data)
+		return nil
 	})
+	assert.Nil(t, err)
 	assert.Equal(t, 2, prefixCount)
 
-	err = store.AllBucketsForDay(minTime, func(name []byte, b *bolt.Bucket, k []byte, v []byte) error {
-		fmt.Printf("All Buckets For Day [%s] key=%s, value=%s\n", string(name), k, v)
+	dayCount := 0
+	err = store.AllBucketsForDay(minTime, func(h storage.History) error {
+		dayCount++
+		fmt.Printf("All Buckets For Day [%s] key=%s, value=%s\n", h.DirectoryName, h.Key, h.Data)
 		return nil
 	})
 	assert.Nil(t, err)
+	assert.Equal(t, 3, dayCount)
 
 	fmt.Println("Last...")
 	lastEntries, err := store.Last("/tmp", 1)
@@ -351,3 +274,1253 @@ func TestAnother(t *testing.T) {
 	}
 
 }
+
+func TestParseKey(t *testing.T) {
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 5, time.FixedZone("SAST", 2*60*60))
+	key := storage.MakeKey(timestamp, 42)
+	parsed, seq, err := storage.ParseKey(key)
+	assert.Nil(t, err)
+	assert.True(t, timestamp.Equal(parsed))
+	assert.Equal(t, uint64(42), seq)
+
+	parsed, seq, err = storage.ParseKey([]byte("2020-01-01T10:00:00Z"))
+	assert.Nil(t, err)
+	assert.True(t, time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC).Equal(parsed))
+	assert.Equal(t, uint64(0), seq)
+
+	_, _, err = storage.ParseKey([]byte("not a key"))
+	assert.NotNil(t, err)
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "history.db")
+
+	db, err := bolt.Open(dbFile, 0600, nil)
+	assert.Nil(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("/tmp"))
+		if err != nil {
+			return err
+		}
+		b.Put([]byte("2020-01-01T10:00:00Z"), []byte("ls"))
+		b.Put([]byte("2020-01-01T12:00:00+02:00"), []byte("make"))
+		a, err := tx.CreateBucket([]byte("annotations-/tmp"))
+		if err != nil {
+			return err
+		}
+		return a.Put([]byte("2020-01-01T10:00:00Z"), []byte("listing"))
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	store, err := storage.NewStore(dbFile, storage.WithoutMigrations())
+	assert.Nil(t, err)
+	version, err := store.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+
+	pending, err := store.Migrate(true)
+	assert.Nil(t, err)
+	assert.Len(t, pending, storage.SchemaVersion()-1)
+	version, err = store.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+	store.Close()
+
+	store, err = storage.NewStore(dbFile)
+	assert.Nil(t, err)
+	defer store.Close()
+	version, err = store.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, storage.SchemaVersion(), version)
+
+	entries, err := store.Last("/tmp", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "make", entries[0].Data)
+	assert.Equal(t, "ls", entries[1].Data)
+	assert.Equal(t, "listing", entries[1].Annotation)
+	for _, entry := range entries {
+		_, seq, err := storage.ParseKey([]byte(entry.Key))
+		assert.Nil(t, err)
+		assert.NotZero(t, seq)
+	}
+
+	latest, err := store.Latest(10)
+	assert.Nil(t, err)
+	assert.Len(t, latest, 2)
+}
+
+func TestAnnotationsDoNotLeak(t *testing.T) {
+	store, err := newTestStore(t)
+	assert.Nil(t, err)
+
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	data := []struct {
+		directory  string
+		command    string
+		annotation string
+	}{
+		{directory: "/tmp", command: "ls", annotation: "ticket ABC-1"},
+		{directory: "annotations-/tmp", command: "pwd"},
+	}
+	for _, datum := range data {
+		history, err := storage.NewHistory(
+			datum.command,
+			storage.SetDirectory(datum.directory),
+			storage.SetTime(timestamp),
+			storage.SetAnnotation(datum.annotation),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+
+	results, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	results, err = store.Greps("ticket")
+	assert.Nil(t, err)
+	assert.Len(t, results, 0)
+
+	dayCount := 0
+	err = store.AllBucketsForDay(timestamp, func(h storage.History) error {
+		dayCount++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dayCount)
+
+	entries, err := store.Last("annotations-/tmp", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "pwd", entries[0].Data)
+	assert.Equal(t, "", entries[0].Annotation)
+}
+
+// newTestStore opens a bbolt store in a temporary directory that is removed
+// when the test finishes.
+func newTestStore(t *testing.T) (*storage.Store, error) {
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(store.Close)
+	return store, nil
+}
+
+func TestLockedInsertIsSpooled(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "history.db")
+	spoolFile := filepath.Join(dir, "spool.jsonl")
+
+	holder, err := storage.NewStore(dbFile)
+	assert.Nil(t, err)
+
+	_, err = storage.NewStore(dbFile, storage.WithTimeout(50*time.Millisecond))
+	assert.Equal(t, storage.ErrLocked, err)
+
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, command := range []string{"make", "make test"} {
+		history, err := storage.NewHistory(
+			command,
+			storage.SetDirectory("/src"),
+			storage.SetTime(timestamp),
+			storage.SetExitCode(1),
+			storage.SetAnnotation("spooled"),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, storage.AppendToSpool(spoolFile, history, storage.DedupNone, nil))
+	}
+	holder.Close()
+
+	store, err := storage.NewStore(dbFile, storage.WithTimeout(50*time.Millisecond))
+	assert.Nil(t, err)
+	defer store.Close()
+	count, err := store.DrainSpool(spoolFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	_, err = os.Stat(spoolFile)
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := store.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "make test", entries[0].Data)
+	assert.Equal(t, 1, entries[0].ExitCode)
+	assert.Equal(t, "spooled", entries[0].Annotation)
+
+	count, err = store.DrainSpool(spoolFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// The dedup mode of the insert that spooled the entry is kept.
+	history, err := storage.NewHistory("make test", storage.SetDirectory("/src"), storage.SetTime(timestamp.Add(time.Minute)))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.AppendToSpool(spoolFile, history, storage.DedupEraseDups, nil))
+	count, err = store.DrainSpool(spoolFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	entries, err = store.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestSpoolRejectsBrokenLines(t *testing.T) {
+	dir := t.TempDir()
+	spoolFile := filepath.Join(dir, "spool.jsonl")
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	history, err := storage.NewHistory("make", storage.SetDirectory("/src"))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.AppendToSpool(spoolFile, history, storage.DedupNone, nil))
+	f, err := os.OpenFile(spoolFile, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	_, err = f.WriteString("{\"dir\":\"/src\",\"rec\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, storage.AppendToSpool(spoolFile, history, storage.DedupNone, nil))
+
+	count, err := store.DrainSpool(spoolFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	rejected, err := ioutil.ReadFile(spoolFile + ".rejected")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"dir\":\"/src\",\"rec\n", string(rejected))
+}
+
+func TestSpoolIsSealedForEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "history.db")
+	spoolFile := filepath.Join(dir, "spool.jsonl")
+	secret := storage.Passphrase("hunter2")
+
+	holder, err := storage.NewStore(dbFile, storage.WithSecret(secret))
+	assert.Nil(t, err)
+	for _, command := range []string{"curl -H secret-token", "ls"} {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"), storage.SetAnnotation("secret-note"))
+		assert.Nil(t, err)
+		assert.Nil(t, storage.AppendToSpool(spoolFile, history, storage.DedupNone, secret))
+	}
+	holder.Close()
+
+	raw, err := ioutil.ReadFile(spoolFile)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret-token")))
+	assert.False(t, bytes.Contains(raw, []byte("secret-note")))
+	assert.False(t, bytes.Contains(raw, []byte("/src")))
+
+	store, err := storage.NewStore(dbFile, storage.WithSecret(secret))
+	assert.Nil(t, err)
+	defer store.Close()
+	count, err := store.DrainSpool(spoolFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	entries, err := store.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "curl -H secret-token", entries[1].Data)
+	assert.Equal(t, "secret-note", entries[1].Annotation)
+}
+
+func TestDedupModes(t *testing.T) {
+	testCases := []struct {
+		mode     storage.DedupMode
+		expected []string
+	}{
+		{mode: storage.DedupNone, expected: []string{"make test", "make  test", "ls", "make test"}},
+		{mode: storage.DedupIgnoreDups, expected: []string{"make  test", "ls", "make test"}},
+		{mode: storage.DedupEraseDups, expected: []string{"make test", "ls"}},
+	}
+	for _, testCase := range testCases {
+		store, err := storage.NewStore(filepath.Join(t.TempDir(), "history.db"), storage.WithDedup(testCase.mode))
+		assert.Nil(t, err)
+
+		timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+		for i, command := range []string{"make test", "ls", "make  test", "make test"} {
+			history, err := storage.NewHistory(
+				command,
+				storage.SetDirectory("/src"),
+				storage.SetTime(timestamp.Add(time.Duration(i)*time.Minute)),
+			)
+			assert.Nil(t, err)
+			assert.Nil(t, store.Add(history))
+			assert.NotEmpty(t, history.Key)
+		}
+
+		entries, err := store.Last("/src", 10)
+		assert.Nil(t, err)
+		commands := []string{}
+		for _, entry := range entries {
+			commands = append(commands, entry.Data)
+		}
+		assert.Equal(t, testCase.expected, commands)
+
+		usages, err := store.Usage("/src")
+		assert.Nil(t, err)
+		assert.Len(t, usages, 2)
+		assert.Equal(t, "make test", usages[0].Command)
+		assert.Equal(t, 3, usages[0].Count)
+		assert.True(t, timestamp.Equal(usages[0].FirstSeen))
+		assert.True(t, timestamp.Add(3*time.Minute).Equal(usages[0].LastSeen))
+		assert.Equal(t, 1, usages[1].Count)
+		store.Close()
+	}
+}
+
+func TestEraseDupsFindsEarlierRuns(t *testing.T) {
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	timestamp := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	add := func(command string, minutes int, mode storage.DedupMode) {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"),
+			storage.SetTime(timestamp.Add(time.Duration(minutes)*time.Minute)))
+		assert.Nil(t, err)
+		assert.Nil(t, store.AddDeduped(history, mode))
+	}
+	commands := func() []string {
+		entries, err := store.Last("/src", 10)
+		assert.Nil(t, err)
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Data)
+		}
+		return result
+	}
+	// Runs stored before erasedups was used are erased too.
+	add("ls", 0, storage.DedupNone)
+	add("make", 1, storage.DedupNone)
+	add("ls", 2, storage.DedupNone)
+	add("ls", 3, storage.DedupEraseDups)
+	assert.Equal(t, []string{"ls", "make"}, commands())
+	add("pwd", 4, storage.DedupEraseDups)
+	add("ls", 5, storage.DedupEraseDups)
+	assert.Equal(t, []string{"ls", "pwd", "make"}, commands())
+	// A run from before the one erasedups kept.
+	add("ls", -1, storage.DedupNone)
+	add("ls", 6, storage.DedupEraseDups)
+	assert.Equal(t, []string{"ls", "pwd", "make"}, commands())
+
+	usages, err := store.Usage("/src")
+	assert.Nil(t, err)
+	assert.Equal(t, "ls", usages[0].Command)
+	assert.Equal(t, 6, usages[0].Count)
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	newStore := func() *storage.Store {
+		store, err := storage.NewStore(
+			filepath.Join(t.TempDir(), "history.db"),
+			storage.WithClock(func() time.Time { return now }),
+		)
+		assert.Nil(t, err)
+		data := []struct {
+			directory string
+			age       time.Duration
+			command   string
+		}{
+			{directory: "/a", age: 3 * 365 * 24 * time.Hour, command: "ancient"},
+			{directory: "/a", age: 48 * time.Hour, command: "export TOKEN=abc"},
+			{directory: "/a", age: time.Hour, command: "ls"},
+			{directory: "/b", age: 3 * 365 * 24 * time.Hour, command: "old ls"},
+			{directory: "/b", age: time.Minute, command: "make"},
+		}
+		for _, datum := range data {
+			history, err := storage.NewHistory(
+				datum.command,
+				storage.SetDirectory(datum.directory),
+				storage.SetTime(now.Add(-datum.age)),
+				storage.SetAnnotation("note"),
+			)
+			assert.Nil(t, err)
+			assert.Nil(t, store.Add(history))
+		}
+		return store
+	}
+	commands := func(entries []storage.History) []string {
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Data)
+		}
+		return result
+	}
+
+	testCases := []struct {
+		policy   storage.PrunePolicy
+		expected []string
+	}{
+		{policy: storage.PrunePolicy{OlderThan: 2 * 365 * 24 * time.Hour}, expected: []string{"ancient", "old ls"}},
+		{policy: storage.PrunePolicy{KeepLast: 1}, expected: []string{"export TOKEN=abc", "ancient", "old ls"}},
+		{policy: storage.PrunePolicy{KeepLast: 1, Directory: "/b"}, expected: []string{"old ls"}},
+		{policy: storage.PrunePolicy{Match: regexp.MustCompile("TOKEN")}, expected: []string{"export TOKEN=abc"}},
+		{policy: storage.PrunePolicy{Match: regexp.MustCompile("ls"), OlderThan: 24 * time.Hour}, expected: []string{"old ls"}},
+	}
+	for _, testCase := range testCases {
+		store := newStore()
+		preview, err := store.Prune(testCase.policy, true)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, testCase.expected, commands(preview))
+		all, err := store.All()
+		assert.Nil(t, err)
+		assert.Len(t, all, 5)
+
+		pruned, err := store.Prune(testCase.policy, false)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, testCase.expected, commands(pruned))
+		all, err = store.All()
+		assert.Nil(t, err)
+		assert.Len(t, all, 5-len(testCase.expected))
+		latest, err := store.Last("", 10)
+		assert.Nil(t, err)
+		assert.Len(t, latest, 5-len(testCase.expected))
+		for _, history := range pruned {
+			_, err := store.Get(history.DirectoryName, history.Key)
+			assert.NotNil(t, err)
+		}
+		store.Close()
+	}
+
+	store := newStore()
+	defer store.Close()
+	policy := storage.PrunePolicy{OlderThan: 2 * 365 * 24 * time.Hour}
+	ran, pruned, err := store.AutoPrune(policy, 24*time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, ran)
+	assert.Len(t, pruned, 2)
+	ran, _, err = store.AutoPrune(policy, 24*time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, ran)
+}
+
+func TestCompact(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "history.db")
+	store, err := storage.NewStore(dbFile)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2000; i++ {
+		directory := "/keep"
+		if i%10 != 0 {
+			directory = "/drop"
+		}
+		history, err := storage.NewHistory(
+			fmt.Sprintf("echo %d %s", i, strings.Repeat("x", 100)),
+			storage.SetDirectory(directory),
+			storage.SetTime(start.Add(time.Duration(i)*time.Second)),
+			storage.SetAnnotation("note"),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	_, err = store.Prune(storage.PrunePolicy{Directory: "/drop"}, false)
+	assert.Nil(t, err)
+	kept, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, kept, 200)
+
+	before, after, err := store.Compact()
+	assert.Nil(t, err)
+	assert.True(t, after < before, "%d should be smaller than %d", after, before)
+	info, err := os.Stat(dbFile)
+	assert.Nil(t, err)
+	assert.Equal(t, after, info.Size())
+	_, err = os.Stat(dbFile + ".compact")
+	assert.True(t, os.IsNotExist(err))
+
+	compacted, err := store.All()
+	assert.Nil(t, err)
+	assert.Equal(t, kept, compacted)
+	latest, err := store.Last("", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, kept[len(kept)-1], latest[0])
+
+	// Sequences survive, so new keys do not collide with the copied ones.
+	history, err := storage.NewHistory("ls", storage.SetDirectory("/keep"), storage.SetTime(start))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(history))
+	all, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 201)
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	add := func(command string) {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"), storage.SetAnnotation("note"))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	add("make")
+	add("make test")
+
+	snapshot := filepath.Join(dir, storage.BackupFileName(time.Now()))
+	size, err := store.Backup(snapshot)
+	assert.Nil(t, err)
+	info, err := os.Stat(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+	version, err := storage.ValidateBackup(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.SchemaVersion(), version)
+
+	add("rm -rf build")
+	all, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 3)
+
+	garbage := filepath.Join(dir, "garbage.db")
+	assert.Nil(t, ioutil.WriteFile(garbage, []byte(strings.Repeat("historian", 1000)), 0600))
+	_, err = storage.ValidateBackup(garbage)
+	assert.NotNil(t, err)
+	assert.NotNil(t, store.Restore(garbage))
+	assert.NotNil(t, store.Restore(filepath.Join(dir, "missing.db")))
+
+	assert.Nil(t, store.Restore(snapshot))
+	all, err = store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, "note", all[0].Annotation)
+	add("ls")
+	latest, err := store.Last("", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "ls", latest[0].Data)
+}
+
+func TestRestoreKeepsDatabaseOnEncryptionMismatch(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef"), 0600))
+	key, err := storage.KeyFile(keyFile)
+	assert.Nil(t, err)
+
+	snapshot := func(name string, options ...storage.StoreOption) string {
+		path := filepath.Join(dir, name)
+		store, err := storage.NewStore(path, options...)
+		assert.Nil(t, err)
+		history, err := storage.NewHistory("from "+name, storage.SetDirectory("/src"))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+		store.Close()
+		return path
+	}
+	encrypted := snapshot("encrypted.db", storage.WithSecret(key))
+	plain := snapshot("plain.db")
+
+	testCases := []struct {
+		name     string
+		options  []storage.StoreOption
+		snapshot string
+		expected error
+	}{
+		{name: "current.db", snapshot: encrypted, expected: storage.ErrEncrypted},
+		{name: "current-encrypted.db", options: []storage.StoreOption{storage.WithSecret(key)}, snapshot: plain, expected: storage.ErrNotEncrypted},
+	}
+	for _, testCase := range testCases {
+		path := snapshot(testCase.name, testCase.options...)
+		store, err := storage.NewStore(path, testCase.options...)
+		assert.Nil(t, err)
+		err = store.Restore(testCase.snapshot)
+		assert.True(t, errors.Is(err, testCase.expected), "%v", err)
+		assert.False(t, errors.Is(err, storage.ErrRestoreIncomplete))
+		all, err := store.All()
+		assert.Nil(t, err)
+		assert.Len(t, all, 1)
+		assert.Equal(t, "from "+testCase.name, all[0].Data)
+		store.Close()
+
+		reopened, err := storage.NewStore(path, testCase.options...)
+		assert.Nil(t, err)
+		reopened.Close()
+		_, err = os.Stat(path + ".restore")
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		name := storage.BackupFileName(start.Add(time.Duration(i) * time.Hour))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600))
+
+	removed, err := storage.RotateBackups(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "history-20210101T000000Z.db"),
+		filepath.Join(dir, "history-20210101T010000Z.db"),
+		filepath.Join(dir, "history-20210101T020000Z.db"),
+	}, removed)
+	left, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Nil(t, err)
+	assert.Len(t, left, 3)
+}
+
+func TestFsck(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "history.db")
+	store, err := storage.NewStore(dbFile)
+	assert.Nil(t, err)
+	for _, command := range []string{"make", "make test"} {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"), storage.SetAnnotation("note"))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	all, err := store.All()
+	assert.Nil(t, err)
+	store.Close()
+
+	db, err := bolt.Open(dbFile, 0600, nil)
+	assert.Nil(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		dirs := tx.Bucket([]byte("dirs"))
+		src := dirs.Bucket([]byte("/src"))
+		if err := src.Put([]byte("yesterday"), []byte("ls")); err != nil {
+			return err
+		}
+		if err := src.Put([]byte(storage.MakeKey(time.Now(), 99)), []byte{'l', 0xff}); err != nil {
+			return err
+		}
+		if _, err := dirs.CreateBucket([]byte("/empty")); err != nil {
+			return err
+		}
+		annotations := tx.Bucket([]byte("annotations")).Bucket([]byte("/src"))
+		if err := annotations.Put([]byte("nothing"), []byte("note")); err != nil {
+			return err
+		}
+		index := tx.Bucket([]byte("index"))
+		if err := index.Put([]byte("gone\x00/src"), []byte{}); err != nil {
+			return err
+		}
+		return index.Delete([]byte(all[0].Key + "\x00/src"))
+	})
+	assert.Nil(t, err)
+	db.Close()
+
+	store, err = storage.NewStore(dbFile)
+	assert.Nil(t, err)
+	defer store.Close()
+	_, err = store.Last("/src", 10)
+	assert.NotNil(t, err)
+
+	kinds := func(problems []storage.Problem) []storage.ProblemKind {
+		result := []storage.ProblemKind{}
+		for _, problem := range problems {
+			result = append(result, problem.Kind)
+		}
+		return result
+	}
+	expected := []storage.ProblemKind{
+		storage.MissingIndex,
+		storage.InvalidUTF8,
+		storage.BadKey,
+		storage.EmptyBucket,
+		storage.OrphanAnnotation,
+		storage.DanglingIndex,
+	}
+	problems, err := store.Fsck(false)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, expected, kinds(problems))
+	for _, problem := range problems {
+		assert.Empty(t, problem.Repair)
+	}
+
+	problems, err = store.Fsck(true)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, expected, kinds(problems))
+	for _, problem := range problems {
+		assert.NotEmpty(t, problem.Repair, problem.String())
+	}
+	problems, err = store.Fsck(false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+
+	latest, err := store.Last("", 10)
+	assert.Nil(t, err)
+	assert.Len(t, latest, 2)
+	entries, err := store.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "note", entries[1].Annotation)
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "history.db")
+	keyFile := filepath.Join(dir, "key")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef"), 0600))
+	key, err := storage.KeyFile(keyFile)
+	assert.Nil(t, err)
+	_, err = storage.KeyFile(dbFile)
+	assert.NotNil(t, err)
+
+	store, err := storage.NewStore(dbFile, storage.WithSecret(storage.Passphrase("hunter2")))
+	assert.Nil(t, err)
+	assert.True(t, store.Encrypted())
+	for _, command := range []string{"curl -H secret-token", "curl -H secret-token", "ls"} {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"), storage.SetAnnotation("secret-note"))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	problems, err := store.Fsck(false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+	store.Close()
+
+	raw, err := ioutil.ReadFile(dbFile)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret-token")))
+	assert.False(t, bytes.Contains(raw, []byte("secret-note")))
+
+	_, err = storage.NewStore(dbFile)
+	assert.Equal(t, storage.ErrEncrypted, err)
+	_, err = storage.NewStore(dbFile, storage.WithSecret(storage.Passphrase("hunter3")))
+	assert.Equal(t, storage.ErrWrongSecret, err)
+
+	store, err = storage.NewStore(dbFile, storage.WithSecret(storage.Passphrase("hunter2")))
+	assert.Nil(t, err)
+	entries, err := store.Last("", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "ls", entries[0].Data)
+	assert.Equal(t, "secret-note", entries[0].Annotation)
+	usage, err := store.Usage("/src")
+	assert.Nil(t, err)
+	assert.Len(t, usage, 2)
+
+	assert.Nil(t, store.Rekey(key))
+	assert.Nil(t, store.Delete("/src", entries[0].Key))
+	store.Close()
+	_, err = storage.NewStore(dbFile, storage.WithSecret(storage.Passphrase("hunter2")))
+	assert.Equal(t, storage.ErrWrongSecret, err)
+
+	store, err = storage.NewStore(dbFile, storage.WithSecret(key))
+	assert.Nil(t, err)
+	usage, err = store.Usage("")
+	assert.Nil(t, err)
+	assert.Equal(t, []storage.Usage{{Command: "curl -H secret-token", Directory: "/src", Count: 2, FirstSeen: usage[0].FirstSeen, LastSeen: usage[0].LastSeen}}, usage)
+	assert.Nil(t, store.Rekey(nil))
+	assert.False(t, store.Encrypted())
+	store.Close()
+
+	store, err = storage.NewStore(dbFile)
+	assert.Nil(t, err)
+	all, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, "secret-note", all[0].Annotation)
+	problems, err = store.Fsck(false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+
+	store.Close()
+
+	other, err := storage.NewStore(filepath.Join(dir, "other.db"), storage.WithSecret(key))
+	assert.Nil(t, err)
+	assert.True(t, other.Encrypted())
+	other.Close()
+	_, err = storage.NewStore(dbFile, storage.WithSecret(key))
+	assert.Equal(t, storage.ErrNotEncrypted, err)
+}
+
+func TestRekeyQuarantine(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "history.db")
+	store, err := storage.NewStore(dbFile, storage.WithSecret(storage.Passphrase("hunter2")))
+	assert.Nil(t, err)
+	history, err := storage.NewHistory("make", storage.SetDirectory("/src"), storage.SetAnnotation("secret-note"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(history))
+	store.Close()
+
+	db, err := bolt.Open(dbFile, 0600, nil)
+	assert.Nil(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		src := tx.Bucket([]byte("dirs")).Bucket([]byte("/src"))
+		if err := src.Put([]byte("garbage"), []byte("not sealed")); err != nil {
+			return err
+		}
+		return src.Delete([]byte(history.Key))
+	})
+	assert.Nil(t, err)
+	db.Close()
+
+	store, err = storage.NewStore(dbFile, storage.WithSecret(storage.Passphrase("hunter2")))
+	assert.Nil(t, err)
+	_, err = store.Fsck(true)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Rekey(storage.Passphrase("hunter3")))
+	assert.Nil(t, store.Rekey(nil))
+	store.Close()
+
+	db, err = bolt.Open(dbFile, 0600, nil)
+	assert.Nil(t, err)
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket([]byte("quarantine"))
+		annotation := quarantine.Bucket([]byte("annotations")).Bucket([]byte("/src")).Get([]byte(history.Key))
+		assert.Equal(t, "secret-note", string(annotation))
+		garbage := quarantine.Bucket([]byte("dirs")).Bucket([]byte("/src")).Get([]byte("garbage"))
+		assert.Equal(t, "not sealed", string(garbage))
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestRedaction(t *testing.T) {
+	store, err := storage.NewStore(
+		filepath.Join(t.TempDir(), "history.db"),
+		storage.WithRedactor(redact.New(redact.Builtin()...)),
+	)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	history, err := storage.NewHistory(
+		"export GITHUB_TOKEN=abc123",
+		storage.SetDirectory("/src"),
+		storage.SetAnnotation("password=hunter2"),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(history))
+	stored, err := store.Get("/src", history.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "export GITHUB_TOKEN=[REDACTED]", stored.Data)
+	assert.Equal(t, "password=[REDACTED]", stored.Annotation)
+
+	stored.Data = "ls"
+	stored.Annotation = ""
+	assert.Nil(t, store.Update(stored))
+	updated, err := store.Get("/src", history.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "ls", updated.Data)
+	assert.Empty(t, updated.Annotation)
+	usage, err := store.Usage("/src")
+	assert.Nil(t, err)
+	assert.Len(t, usage, 1)
+	assert.Equal(t, "ls", usage[0].Command)
+
+	stored.Key = "missing"
+	assert.NotNil(t, store.Update(stored))
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	otherFile := filepath.Join(dir, "other.db")
+	other, err := storage.NewStore(otherFile)
+	assert.Nil(t, err)
+
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	add := func(s *storage.Store, command, directory string, minutes int, annotation string) {
+		history, err := storage.NewHistory(command, storage.SetDirectory(directory),
+			storage.SetTime(start.Add(time.Duration(minutes)*time.Minute)), storage.SetAnnotation(annotation))
+		assert.Nil(t, err)
+		assert.Nil(t, s.Add(history))
+	}
+	add(store, "make", "/src", 0, "")
+	add(store, "ls", "/tmp", 1, "")
+	add(other, "make", "/src", 0, "builds it")
+	add(other, "make", "/src", 5, "")
+	add(other, "git push", "/src", 6, "")
+	add(other, "ls", "/home", 1, "")
+	other.Close()
+
+	report, err := store.Merge(otherFile, storage.MergeOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, storage.MergeReport{Directories: 2, Added: 3, Duplicates: 1, Annotations: 1}, report)
+	all, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 2)
+
+	report, err = store.Merge(otherFile, storage.MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Added)
+	all, err = store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 5)
+	history, err := store.Last("/src", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "builds it", history[2].Annotation)
+	usages, err := store.Usage("/src")
+	assert.Nil(t, err)
+	counts := map[string]int{}
+	for _, usage := range usages {
+		counts[usage.Command] = usage.Count
+	}
+	assert.Equal(t, map[string]int{"make": 2, "git push": 1}, counts)
+
+	// Merging again finds nothing new.
+	report, err = store.Merge(otherFile, storage.MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, storage.MergeReport{Directories: 2, Duplicates: 4}, report)
+
+	_, err = store.Merge(filepath.Join(dir, "missing.db"), storage.MergeOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestMergeKeepsDistinctRecords(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	otherFile := filepath.Join(dir, "other.db")
+	other, err := storage.NewStore(otherFile)
+	assert.Nil(t, err)
+
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	add := func(s *storage.Store, options ...storage.HistOption) {
+		options = append(options, storage.SetDirectory("/src"), storage.SetTime(start))
+		history, err := storage.NewHistory("make", options...)
+		assert.Nil(t, err)
+		assert.Nil(t, s.Add(history))
+	}
+	add(store, storage.SetHostname("laptop"), storage.SetTTY("/dev/pts/1"))
+	add(other, storage.SetHostname("laptop"), storage.SetTTY("/dev/pts/1"), storage.SetAnnotation("builds it"))
+	add(other, storage.SetHostname("desktop"), storage.SetTTY("/dev/pts/1"))
+	add(other, storage.SetHostname("laptop"), storage.SetTTY("/dev/pts/1"), storage.SetExitCode(2))
+	other.Close()
+
+	report, err := store.Merge(otherFile, storage.MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, storage.MergeReport{Directories: 1, Added: 2, Duplicates: 1, Annotations: 1}, report)
+	entries, err := store.Last("/src", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestImport(t *testing.T) {
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	start := time.Date(2021, 1, 31, 9, 0, 0, 0, time.UTC)
+	existing, err := storage.NewHistory("make", storage.SetDirectory("/home/alice/code"), storage.SetTime(start))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(existing))
+
+	entries := []storage.History{
+		{Data: "make", DirectoryName: "/Users/alice/src", Time: start},
+		{Data: "git push", DirectoryName: "/Users/alice/src", Time: start.Add(time.Minute)},
+		{Data: "ls", DirectoryName: "/tmp", Time: start.Add(2 * time.Minute)},
+	}
+	paths, err := storage.ParsePathMap([]string{"/Users/alice/src=/home/alice/code"})
+	assert.Nil(t, err)
+	options := storage.ImportOptions{DryRun: true, Paths: paths}
+	report, err := store.Import(entries, options)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.ImportReport{Added: 2, Duplicates: 1, Rewritten: 2}, report)
+	all, err := store.All()
+	assert.Nil(t, err)
+	assert.Len(t, all, 1)
+
+	options.DryRun = false
+	_, err = store.Import(entries, options)
+	assert.Nil(t, err)
+	history, err := store.Last("/home/alice/code", 5)
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+	changes, _, err := store.Changes(0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, changes, 3)
+
+	options.Cursor, options.Position = "watch:/tmp/history", "42"
+	report, err = store.Import(entries, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Duplicates)
+	position, err := store.Cursor("watch:/tmp/history")
+	assert.Nil(t, err)
+	assert.Equal(t, "42", position)
+
+	_, err = store.Import([]storage.History{{Data: "ls", Time: start}}, options)
+	assert.NotNil(t, err)
+}
+
+func TestPathMap(t *testing.T) {
+	paths, err := storage.ParsePathMap([]string{
+		"/Users/alice/src/work=/home/alice/work",
+		"/Users/alice/src/=/home/alice/code",
+		"/Users/alice=/home/alice",
+	})
+	assert.Nil(t, err)
+	testCases := []struct {
+		directory string
+		expected  string
+		rewritten bool
+	}{
+		{"/Users/alice/src/work/api", "/home/alice/work/api", true},
+		{"/Users/alice/src/foo", "/home/alice/code/foo", true},
+		{"/Users/alice/src", "/home/alice/code", true},
+		{"/Users/alice/srcs", "/home/alice/srcs", true},
+		{"/Users/bob/src", "/Users/bob/src", false},
+		{"/Users/alicia", "/Users/alicia", false},
+	}
+	for _, testCase := range testCases {
+		directory, rewritten := paths.Rewrite(testCase.directory)
+		assert.Equal(t, testCase.expected, directory, testCase.directory)
+		assert.Equal(t, testCase.rewritten, rewritten, testCase.directory)
+	}
+	for _, spec := range []string{"/src", "=/dst", "/src="} {
+		_, err := storage.ParsePathRule(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestRewritePaths(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	add := func(command, directory string, minutes int, annotation string) {
+		history, err := storage.NewHistory(command, storage.SetDirectory(directory),
+			storage.SetTime(start.Add(time.Duration(minutes)*time.Minute)), storage.SetAnnotation(annotation))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	add("make", "/Users/alice/src/foo", 0, "old laptop")
+	add("make test", "/Users/alice/src/foo", 1, "")
+	add("make", "/home/alice/code/foo", 0, "")
+	add("make", "/home/alice/code/foo", 2, "")
+	add("ls", "/tmp", 3, "")
+
+	paths, err := storage.ParsePathMap([]string{"/Users/alice/src=/home/alice/code"})
+	assert.Nil(t, err)
+	moves, err := store.RewritePaths(paths, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []storage.PathMove{{From: "/Users/alice/src/foo", To: "/home/alice/code/foo", Entries: 1, Duplicates: 1}}, moves)
+	history, err := store.Last("/Users/alice/src/foo", 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+
+	moves, err = store.RewritePaths(paths, false)
+	assert.Nil(t, err)
+	assert.Len(t, moves, 1)
+	_, err = store.Last("/Users/alice/src/foo", 10)
+	assert.NotNil(t, err, "the old directory is gone")
+	history, err = store.Last("/home/alice/code/foo", 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 3)
+	assert.Equal(t, "make test", history[1].Data)
+	assert.Equal(t, "old laptop", history[2].Annotation)
+
+	usages, err := store.Usage("/home/alice/code/foo")
+	assert.Nil(t, err)
+	counts := map[string]int{}
+	for _, usage := range usages {
+		counts[usage.Command] = usage.Count
+	}
+	assert.Equal(t, map[string]int{"make": 2, "make test": 1}, counts)
+	usages, err = store.Usage("/Users/alice/src/foo")
+	assert.Nil(t, err)
+	assert.Len(t, usages, 0)
+
+	problems, err := store.Fsck(false)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 0)
+}
+
+func TestRewritePathsChained(t *testing.T) {
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "history.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	for i, entry := range [][2]string{{"ls", "/a"}, {"pwd", "/b"}} {
+		history, err := storage.NewHistory(entry[0], storage.SetDirectory(entry[1]),
+			storage.SetTime(start.Add(time.Duration(i)*time.Minute)))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+
+	paths, err := storage.ParsePathMap([]string{"/a=/b", "/b=/c"})
+	assert.Nil(t, err)
+	moves, err := store.RewritePaths(paths, false)
+	assert.Nil(t, err)
+	assert.Len(t, moves, 2)
+	for directory, command := range map[string]string{"/b": "ls", "/c": "pwd"} {
+		history, err := store.Last(directory, 10)
+		assert.Nil(t, err)
+		assert.Len(t, history, 1)
+		assert.Equal(t, command, history[0].Data)
+		usages, err := store.Usage(directory)
+		assert.Nil(t, err)
+		assert.Len(t, usages, 1)
+		assert.Equal(t, command, usages[0].Command)
+		assert.Equal(t, 1, usages[0].Count)
+	}
+
+	changes, _, err := store.Changes(0, 0)
+	assert.Nil(t, err)
+	directories := []string{}
+	for _, change := range changes {
+		directories = append(directories, change.Directory)
+	}
+	assert.ElementsMatch(t, []string{"/b", "/c"}, directories)
+}
+
+func TestSyncDir(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote")
+	assert.Nil(t, os.Mkdir(remote, 0700))
+	open := func(name string) *storage.Store {
+		store, err := storage.NewStore(filepath.Join(dir, name+".db"))
+		assert.Nil(t, err)
+		return store
+	}
+	laptop, desktop, server := open("laptop"), open("desktop"), open("server")
+	defer laptop.Close()
+	defer desktop.Close()
+	defer server.Close()
+
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	add := func(store *storage.Store, command string, minutes int) {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"),
+			storage.SetTime(start.Add(time.Duration(minutes)*time.Minute)))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	add(laptop, "make", 0)
+	add(laptop, "make test", 1)
+	add(desktop, "git pull", 2)
+
+	report, err := laptop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Exported)
+	assert.Equal(t, 0, report.Files)
+
+	report, err = desktop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Exported)
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, 2, report.Added)
+
+	add(laptop, "make install", 3)
+	report, err = laptop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Exported, "changes that came in through sync are not passed back")
+	assert.Equal(t, 1, report.Added)
+
+	report, err = server.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Exported)
+	assert.Equal(t, 3, report.Files)
+	assert.Equal(t, 2, report.Machines)
+	assert.Equal(t, 4, report.Added)
+
+	report, err = desktop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.SyncReport{Files: 1, Machines: 1, ApplyReport: storage.ApplyReport{Added: 1}}, report)
+
+	commands := func(store *storage.Store) []string {
+		history, err := store.Last("/src", 10)
+		assert.Nil(t, err)
+		result := []string{}
+		for _, h := range history {
+			result = append(result, h.Data)
+		}
+		return result
+	}
+	expected := []string{"make install", "git pull", "make test", "make"}
+	assert.Equal(t, expected, commands(laptop))
+	assert.Equal(t, expected, commands(desktop))
+	assert.Equal(t, expected, commands(server))
+
+	// Nothing new, nothing exchanged, and a lost cursor only finds duplicates.
+	report, err = laptop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.SyncReport{}, report)
+	id, err := laptop.MachineID()
+	assert.Nil(t, err)
+	assert.Nil(t, server.SetCursor("import:"+remote+":"+id, ""))
+	report, err = server.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Added)
+	assert.Equal(t, 3, report.Duplicates)
+}
+
+func TestSyncDirCopiedDatabase(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote")
+	assert.Nil(t, os.Mkdir(remote, 0700))
+	laptop, err := storage.NewStore(filepath.Join(dir, "laptop.db"))
+	assert.Nil(t, err)
+	defer laptop.Close()
+
+	start := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	add := func(store *storage.Store, command string, minutes int) {
+		history, err := storage.NewHistory(command, storage.SetDirectory("/src"),
+			storage.SetTime(start.Add(time.Duration(minutes)*time.Minute)))
+		assert.Nil(t, err)
+		assert.Nil(t, store.Add(history))
+	}
+	add(laptop, "make", 0)
+	_, err = laptop.SyncDir(remote)
+	assert.Nil(t, err)
+	id, err := laptop.MachineID()
+	assert.Nil(t, err)
+
+	// A copy carries on with the same id and journal.
+	copied := filepath.Join(dir, "desktop.db")
+	_, err = laptop.Backup(copied)
+	assert.Nil(t, err)
+	desktop, err := storage.NewStore(copied)
+	assert.Nil(t, err)
+	defer desktop.Close()
+	add(laptop, "make test", 1)
+	add(desktop, "git pull", 2)
+	_, err = laptop.SyncDir(remote)
+	assert.Nil(t, err)
+	_, err = desktop.SyncDir(remote)
+	assert.True(t, errors.Is(err, storage.ErrDuplicateMachineID), "%v", err)
+
+	renamed, err := desktop.NewMachineID()
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, renamed)
+	report, err := desktop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Exported)
+	assert.Equal(t, 1, report.Added)
+	report, err = laptop.SyncDir(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Added)
+
+	// A restored snapshot is behind what its id synced.
+	snapshot := filepath.Join(dir, "snapshot.db")
+	_, err = laptop.Backup(snapshot)
+	assert.Nil(t, err)
+	assert.Nil(t, laptop.Restore(snapshot))
+	restored, err := laptop.MachineID()
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, restored)
+}
+
+func TestSyncDirEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote")
+	assert.Nil(t, os.Mkdir(remote, 0700))
+	store, err := storage.NewStore(filepath.Join(dir, "history.db"), storage.WithSecret(storage.Passphrase("hunter2")))
+	assert.Nil(t, err)
+	defer store.Close()
+	history, err := storage.NewHistory("curl -H secret-token", storage.SetDirectory("/src"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(history))
+
+	_, err = store.SyncDir(remote)
+	assert.Equal(t, storage.ErrSyncEncrypted, err)
+	_, _, err = store.Changes(0, 0)
+	assert.Equal(t, storage.ErrSyncEncrypted, err)
+	files, err := ioutil.ReadDir(remote)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	machineIDKey = []byte("machine-id")
+	// cursorPrefix starts the meta keys of the sync cursors.
+	cursorPrefix = "cursor/"
+)
+
+// ErrDuplicateMachineID is returned when another database syncs under this
+// database's machine id, because one was copied from the other.
+var ErrDuplicateMachineID = errors.New("another database syncs with the same machine id")
+
+// ErrSyncEncrypted is returned when an encrypted database would hand out its
+// entries for syncing. Change files and the sync protocol are not encrypted.
+var ErrSyncEncrypted = errors.New("an encrypted database cannot sync, changes are exchanged in plain text")
+
+// Change is an entry as exchanged between machines. ID is unique across
+// machines: the id of the machine that recorded the entry and the entry's
+// position in that machine's journal.
+type Change struct {
+	ID         string    `json:"id"`
+	Directory  string    `json:"dir"`
+	Command    string    `json:"cmd"`
+	Annotation string    `json:"annotation,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	ExitCode   int       `json:"exit"`
+	SessionID  string    `json:"session,omitempty"`
+	Hostname   string    `json:"host,omitempty"`
+	Username   string    `json:"user,omitempty"`
+	Shell      string    `json:"shell,omitempty"`
+	TTY        string    `json:"tty,omitempty"`
+}
+
+func newChange(id string, history History) Change {
+	return Change{
+		ID:         id,
+		Directory:  history.DirectoryName,
+		Command:    history.Data,
+		Annotation: history.Annotation,
+		Start:      history.Time,
+		End:        history.EndTime,
+		ExitCode:   history.ExitCode,
+		SessionID:  history.SessionID,
+		Hostname:   history.Hostname,
+		Username:   history.Username,
+		Shell:      history.Shell,
+		TTY:        history.TTY,
+	}
+}
+
+func (c Change) history() *History {
+	return &History{
+		Data:          c.Command,
+		Time:          c.Start,
+		DirectoryName: c.Directory,
+		Annotation:    c.Annotation,
+		EndTime:       c.End,
+		ExitCode:      c.ExitCode,
+		SessionID:     c.SessionID,
+		Hostname:      c.Hostname,
+		Username:      c.Username,
+		Shell:         c.Shell,
+		TTY:           c.TTY,
+	}
+}
+
+var unsafeHostname = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// MachineID identifies this database among the ones syncing with each other.
+// It is the host name and a random suffix, made up on first use. A copy of the
+// database has the same id, which sync reports as ErrDuplicateMachineID, see
+// NewMachineID.
+func (s *Store) MachineID() (string, error) {
+	var id string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if existing := meta.Get(machineIDKey); existing != nil {
+			id = string(existing)
+			return nil
+		}
+		id, err = newMachineID()
+		if err != nil {
+			return err
+		}
+		return meta.Put(machineIDKey, []byte(id))
+	})
+	return id, err
+}
+
+// NewMachineID gives the database a new machine id, for a copy of a database
+// or an older snapshot of it that must not sync under the id of the original.
+// Changes recorded from now on are exchanged under the new id, the ones
+// exchanged before are known to the others already.
+func (s *Store) NewMachineID() (string, error) {
+	id, err := newMachineID()
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(machineIDKey, []byte(id))
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func newMachineID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	hostname = unsafeHostname.ReplaceAllString(hostname, "-")
+	if hostname == "" {
+		hostname = "machine"
+	}
+	return hostname + "-" + hex.EncodeToString(suffix), nil
+}
+
+// sameEntry reports whether two changes with the same id are the same entry.
+// The time and directory do not change when an entry is redacted or annotated.
+func (c Change) sameEntry(other Change) bool {
+	return c.Start.Equal(other.Start) && c.Directory == other.Directory
+}
+
+// fingerprint is what Receive keeps of a change to tell it from a different
+// change pushed under the same id, see sameEntry.
+func (c Change) fingerprint() []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", c.Start.UnixNano(), c.Directory)))
+	return sum[:8]
+}
+
+// Changes returns up to limit entries recorded on this machine, or pushed to
+// it when it is a sync server, after journal position after, oldest first,
+// and the position of the last one. Without a limit every entry after the
+// position is returned. Entries deleted since they were recorded are left out.
+// An encrypted database returns ErrSyncEncrypted.
+func (s *Store) Changes(after uint64, limit int) ([]Change, uint64, error) {
+	if s.keys != nil {
+		return nil, after, ErrSyncEncrypted
+	}
+	id, err := s.MachineID()
+	if err != nil {
+		return nil, after, err
+	}
+	changes := []Change{}
+	last := after
+	err = s.db.View(func(tx *bolt.Tx) error {
+		journal := tx.Bucket(journalBucket)
+		if journal == nil {
+			return nil
+		}
+		origins := tx.Bucket(originsBucket)
+		c := journal.Cursor()
+		for k, v := c.Seek(journalPosition(after + 1)); k != nil; k, v = c.Next() {
+			if limit > 0 && len(changes) >= limit {
+				break
+			}
+			last = binary.BigEndian.Uint64(k)
+			history, err := lookupIndexed(tx, s.keys, v)
+			if err != nil {
+				continue
+			}
+			changeID := fmt.Sprintf("%s-%016x", id, last)
+			if origins != nil {
+				if origin := origins.Get(k); origin != nil {
+					changeID = string(origin)
+				}
+			}
+			changes = append(changes, newChange(changeID, history))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, after, err
+	}
+	return changes, last, nil
+}
+
+// ApplyReport sums up ApplyChanges.
+type ApplyReport struct {
+	Added      int
+	Duplicates int
+}
+
+// ApplyChanges adds the changes missing from the store and moves the named
+// cursor to position, all or nothing. The changes count as runs, but are not
+// journaled: they are passed on by the machine that recorded them.
+func (s *Store) ApplyChanges(changes []Change, cursor string, position string) (ApplyReport, error) {
+	report := ApplyReport{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		merged := MergeReport{}
+		for _, change := range changes {
+			if err := s.mergeEntry(tx, change.history(), &merged, false); err != nil {
+				return err
+			}
+		}
+		report.Added, report.Duplicates = merged.Added, merged.Duplicates
+		return writeCursor(tx, cursor, position)
+	})
+	if err != nil {
+		return ApplyReport{}, err
+	}
+	return report, nil
+}
+
+// Receive adds changes pushed to a sync server, skipping the ids received
+// before. A change under an id received before that is not the same entry was
+// pushed by a copy of the database, and is refused with ErrDuplicateMachineID. Unlike ApplyChanges, the entries are journaled, under the ids they
+// were pushed with, to be pulled by the other machines.
+func (s *Store) Receive(changes []Change) (ApplyReport, error) {
+	report := ApplyReport{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		received, err := tx.CreateBucketIfNotExists(receivedBucket)
+		if err != nil {
+			return err
+		}
+		origins, err := tx.CreateBucketIfNotExists(originsBucket)
+		if err != nil {
+			return err
+		}
+		journal, err := tx.CreateBucketIfNotExists(journalBucket)
+		if err != nil {
+			return err
+		}
+		merged := MergeReport{}
+		for _, change := range changes {
+			if change.ID == "" {
+				return fmt.Errorf("change without id")
+			}
+			// Changes received before a fingerprint was kept have none.
+			if fingerprint := received.Get([]byte(change.ID)); fingerprint != nil {
+				if len(fingerprint) > 0 && !bytes.Equal(fingerprint, change.fingerprint()) {
+					return fmt.Errorf("%w: change %s differs from the one received before", ErrDuplicateMachineID, change.ID)
+				}
+				merged.Duplicates++
+				continue
+			}
+			before := journal.Sequence()
+			if err := s.mergeEntry(tx, change.history(), &merged, true); err != nil {
+				return err
+			}
+			if position := journal.Sequence(); position != before {
+				if err := origins.Put(journalPosition(position), []byte(change.ID)); err != nil {
+					return err
+				}
+			}
+			if err := received.Put([]byte(change.ID), change.fingerprint()); err != nil {
+				return err
+			}
+		}
+		report.Added, report.Duplicates = merged.Added, merged.Duplicates
+		return nil
+	})
+	if err != nil {
+		return ApplyReport{}, err
+	}
+	return report, nil
+}
+
+// Cursor returns how far the named sync cursor got, empty when it never moved.
+func (s *Store) Cursor(name string) (string, error) {
+	var position string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			position = string(meta.Get([]byte(cursorPrefix + name)))
+		}
+		return nil
+	})
+	return position, err
+}
+
+// SetCursor moves the named sync cursor to position.
+func (s *Store) SetCursor(name string, position string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return writeCursor(tx, name, position)
+	})
+}
+
+func writeCursor(tx *bolt.Tx, name string, position string) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(cursorPrefix+name), []byte(position))
+}
+
+// ParsePosition reads a journal position kept in a cursor, an empty cursor
+// is the start of the journal.
+func ParsePosition(cursor string) (uint64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	position, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid journal position %q", cursor)
+	}
+	return position, nil
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// A sync directory has a directory per machine, holding change files that
+// are written once and never changed:
+//
+//	<remote>/<machine id>/<first position>-<last position>.jsonl
+//
+// Positions are the machine's journal positions in hexadecimal, so the files
+// sort in the order they were written. A file written again after a crash
+// gets the same name and the same changes.
+var changeFileName = regexp.MustCompile(`^([0-9a-f]{16})-([0-9a-f]{16})\.jsonl$`)
+
+// SyncReport sums up a SyncDir.
+type SyncReport struct {
+	// Exported changes were written to a change file of this machine.
+	Exported int
+	// Files of other machines were imported, from Machines machines.
+	Files    int
+	Machines int
+	ApplyReport
+}
+
+func (r SyncReport) String() string {
+	return fmt.Sprintf("%d exported, %d added and %d duplicates from %d files of %d machines",
+		r.Exported, r.Added, r.Duplicates, r.Files, r.Machines)
+}
+
+// SyncDir exchanges changes with the sync directory remote: the entries
+// recorded here since the last sync are written to a new change file, then
+// the change files of other machines not imported yet are imported. Both
+// directions keep a cursor in the meta bucket, per remote. Change files of a
+// copy of the database in this machine's directory are reported as
+// ErrDuplicateMachineID. An encrypted database returns ErrSyncEncrypted.
+func (s *Store) SyncDir(remote string) (SyncReport, error) {
+	report := SyncReport{}
+	if s.keys != nil {
+		return report, ErrSyncEncrypted
+	}
+	id, err := s.MachineID()
+	if err != nil {
+		return report, err
+	}
+	remote, err = filepath.Abs(remote)
+	if err != nil {
+		return report, err
+	}
+	info, err := os.Stat(remote)
+	if err != nil {
+		return report, err
+	}
+	if !info.IsDir() {
+		return report, fmt.Errorf("%s is not a directory", remote)
+	}
+
+	exported, err := s.exportChanges(remote, id)
+	if err != nil {
+		return report, fmt.Errorf("could not export changes: %w", err)
+	}
+	report.Exported = exported
+
+	machines, err := ioutil.ReadDir(remote)
+	if err != nil {
+		return report, err
+	}
+	for _, machine := range machines {
+		if !machine.IsDir() || machine.Name() == id {
+			continue
+		}
+		files, applied, err := s.importChanges(remote, machine.Name())
+		if err != nil {
+			return report, fmt.Errorf("could not import changes of %s: %w", machine.Name(), err)
+		}
+		if files > 0 {
+			report.Machines++
+		}
+		report.Files += files
+		report.Added += applied.Added
+		report.Duplicates += applied.Duplicates
+	}
+	return report, nil
+}
+
+// exportChanges writes the changes after the export cursor of remote to a
+// change file, then moves the cursor.
+func (s *Store) exportChanges(remote string, id string) (int, error) {
+	cursor := "export:" + remote
+	position, err := s.Cursor(cursor)
+	if err != nil {
+		return 0, err
+	}
+	after, err := ParsePosition(position)
+	if err != nil {
+		return 0, err
+	}
+	changes, last, err := s.Changes(after, 0)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Join(remote, id)
+	if err := checkChangeFiles(dir, after, last, changes); err != nil {
+		return 0, err
+	}
+	if last == after {
+		return 0, nil
+	}
+	if len(changes) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return 0, err
+		}
+		name := fmt.Sprintf("%016x-%016x.jsonl", after+1, last)
+		if err := writeChangeFile(filepath.Join(dir, name), changes); err != nil {
+			return 0, err
+		}
+	}
+	return len(changes), s.SetCursor(cursor, strconv.FormatUint(last, 10))
+}
+
+// checkChangeFiles makes sure the change files in dir, the directory of this
+// machine, were written by this database. Its files up to position after were
+// exported before. A file after it can only be one written again after a
+// crash, starting right after it and holding the changes up to last; any other
+// file was written by a copy of the database.
+func checkChangeFiles(dir string, after, last uint64, changes []Change) error {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ours := make(map[string]Change, len(changes))
+	for _, change := range changes {
+		ours[change.ID] = change
+	}
+	for _, info := range infos {
+		match := changeFileName.FindStringSubmatch(info.Name())
+		if match == nil {
+			continue
+		}
+		first, _ := strconv.ParseUint(match[1], 16, 64)
+		end, _ := strconv.ParseUint(match[2], 16, 64)
+		if end <= after {
+			continue
+		}
+		duplicate := fmt.Errorf("%w: %s was not written by this database", ErrDuplicateMachineID, filepath.Join(dir, info.Name()))
+		if first != after+1 || end > last {
+			return duplicate
+		}
+		written, err := readChangeFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+		for _, change := range written {
+			// Entries deleted since are missing from changes.
+			if mine, ok := ours[change.ID]; ok && !mine.sameEntry(change) {
+				return duplicate
+			}
+		}
+	}
+	return nil
+}
+
+// writeChangeFile writes changes next to path and renames it into place, so
+// other machines never read half a file. Names starting with a dot are
+// skipped by the tools that share the directory, and by importChanges.
+func writeChangeFile(path string, changes []Change) error {
+	partial := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".partial")
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			file.Close()
+			os.Remove(partial)
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(partial)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(partial)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// importChanges applies the change files of machine after its cursor, one
+// file per transaction, moving the cursor along.
+func (s *Store) importChanges(remote string, machine string) (int, ApplyReport, error) {
+	report := ApplyReport{}
+	cursor := "import:" + remote + ":" + machine
+	imported, err := s.Cursor(cursor)
+	if err != nil {
+		return 0, report, err
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(remote, machine))
+	if err != nil {
+		return 0, report, err
+	}
+	files := 0
+	for _, info := range infos {
+		// ReadDir sorts by name, which is the order the files were written.
+		name := info.Name()
+		if !changeFileName.MatchString(name) || name <= imported {
+			continue
+		}
+		changes, err := readChangeFile(filepath.Join(remote, machine, name))
+		if err != nil {
+			return files, report, err
+		}
+		applied, err := s.ApplyChanges(changes, cursor, name)
+		if err != nil {
+			return files, report, fmt.Errorf("%s: %w", name, err)
+		}
+		files++
+		report.Added += applied.Added
+		report.Duplicates += applied.Duplicates
+	}
+	return files, report, nil
+}
+
+func readChangeFile(path string) ([]Change, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	changes := []Change{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, scanner.Err()
+}
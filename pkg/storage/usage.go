@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// commandsBucket counts how often each command ran, per directory:
+//
+//	commands/<directory>  normalized command -> encoded Usage
+var commandsBucket = []byte("commands")
+
+// DedupMode decides what Add does with a command that was run before.
+type DedupMode int
+
+const (
+	// DedupNone stores every command.
+	DedupNone DedupMode = iota
+	// DedupIgnoreDups does not store a command that is the same as the
+	// previous one in the directory, like bash's ignoredups.
+	DedupIgnoreDups
+	// DedupEraseDups removes the earlier entries of a command in the
+	// directory before storing it, like bash's erasedups.
+	DedupEraseDups
+)
+
+var dedupModeNames = map[string]DedupMode{
+	"none":       DedupNone,
+	"ignoredups": DedupIgnoreDups,
+	"erasedups":  DedupEraseDups,
+}
+
+// ParseDedupMode converts "none", "ignoredups" or "erasedups" to a DedupMode.
+func ParseDedupMode(name string) (DedupMode, error) {
+	mode, ok := dedupModeNames[name]
+	if !ok {
+		return DedupNone, fmt.Errorf("unknown dedup mode %q, expected none, ignoredups or erasedups", name)
+	}
+	return mode, nil
+}
+
+// WithDedup sets how Add treats repeated commands.
+func WithDedup(mode DedupMode) StoreOption {
+	return func(s *Store) error {
+		s.dedup = mode
+		return nil
+	}
+}
+
+// Usage counts the runs of one command in one directory. Every run counts,
+// including the ones dedup did not store.
+type Usage struct {
+	Command   string    `json:"cmd"`
+	Directory string    `json:"dir,omitempty"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first"`
+	LastSeen  time.Time `json:"last"`
+}
+
+// usageRecord is a Usage as kept in the commands bucket.
+type usageRecord struct {
+	Usage
+	// Stored is no later than the oldest entry of the command still in the
+	// directory, so erasedups only looks for earlier runs from there. Counts
+	// written before it was kept go by FirstSeen.
+	Stored time.Time `json:"stored,omitempty"`
+}
+
+// storedSince is the time erasedups looks for earlier runs from.
+func (u usageRecord) storedSince() time.Time {
+	if u.Stored.IsZero() {
+		return u.FirstSeen
+	}
+	return u.Stored
+}
+
+// readUsage returns the run count of the normalized command in directory, nil
+// when it never ran there.
+func readUsage(tx *bolt.Tx, keys *keyring, directory []byte, normalized string) (*usageRecord, error) {
+	b := nestedBucket(tx, commandsBucket, directory)
+	if b == nil {
+		return nil, nil
+	}
+	key := keys.commandKey(normalized)
+	value := b.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+	value, err := keys.open(value, commandsBucket, directory, key)
+	if err != nil {
+		return nil, err
+	}
+	usage := &usageRecord{}
+	if err := json.Unmarshal(value, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// writeUsage stores the run count of its command in directory.
+func writeUsage(tx *bolt.Tx, keys *keyring, directory []byte, usage *usageRecord) error {
+	b, err := createNestedBucket(tx, commandsBucket, directory)
+	if err != nil {
+		return err
+	}
+	key := keys.commandKey(usage.Command)
+	value, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	value, err = keys.seal(value, commandsBucket, directory, key)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// NormalizeCommand trims a command and collapses runs of whitespace, so
+// commands that only differ in spacing count as the same command.
+func NormalizeCommand(command string) string {
+	return strings.Join(strings.Fields(command), " ")
+}
+
+// countRun records a run of history's command.
+func countRun(tx *bolt.Tx, keys *keyring, history *History) error {
+	directory := []byte(history.DirectoryName)
+	normalized := NormalizeCommand(history.Data)
+	usage, err := readUsage(tx, keys, directory, normalized)
+	if err != nil {
+		return err
+	}
+	if usage == nil {
+		usage = &usageRecord{Usage: Usage{Command: normalized, FirstSeen: history.Time, LastSeen: history.Time}}
+	}
+	if history.Time.Before(usage.FirstSeen) {
+		usage.FirstSeen = history.Time
+	}
+	if history.Time.After(usage.LastSeen) {
+		usage.LastSeen = history.Time
+	}
+	if !usage.Stored.IsZero() && history.Time.Before(usage.Stored) {
+		usage.Stored = history.Time
+	}
+	usage.Count++
+	return writeUsage(tx, keys, directory, usage)
+}
+
+// uncountRun takes back a run of a deleted entry, forgetting the command once
+// no runs are left.
+func uncountRun(tx *bolt.Tx, keys *keyring, directory []byte, command string) error {
+	normalized := NormalizeCommand(command)
+	usage, err := readUsage(tx, keys, directory, normalized)
+	if err != nil || usage == nil {
+		return err
+	}
+	usage.Count--
+	if usage.Count <= 0 {
+		return nestedBucket(tx, commandsBucket, directory).Delete(keys.commandKey(normalized))
+	}
+	return writeUsage(tx, keys, directory, usage)
+}
+
+// dedupEntry applies the dedup mode before history is added. It returns the
+// key of the previous entry when history should not be stored at all.
+func dedupEntry(tx *bolt.Tx, keys *keyring, mode DedupMode, history *History) ([]byte, error) {
+	b := directoryBucket(tx, []byte(history.DirectoryName))
+	if mode == DedupNone || b == nil {
+		return nil, nil
+	}
+	normalized := NormalizeCommand(history.Data)
+	directory := []byte(history.DirectoryName)
+
+	if mode == DedupIgnoreDups {
+		k, v := b.Cursor().Last()
+		if k == nil {
+			return nil, nil
+		}
+		previous, err := decodeEntry(tx, keys, directory, k, v)
+		if err != nil {
+			return nil, err
+		}
+		if NormalizeCommand(previous.Data) == normalized {
+			return append([]byte{}, k...), nil
+		}
+		return nil, nil
+	}
+
+	// Earlier runs are stored between the oldest entry kept and the last run.
+	usage, err := readUsage(tx, keys, directory, normalized)
+	if err != nil || usage == nil {
+		return nil, err
+	}
+	duplicates := [][]byte{}
+	first, last := keyRange(usage.storedSince(), usage.LastSeen)
+	c := b.Cursor()
+	for k, v := c.Seek(first); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+		previous, err := decodeEntry(tx, keys, directory, k, v)
+		if err != nil {
+			return nil, err
+		}
+		if NormalizeCommand(previous.Data) == normalized {
+			duplicates = append(duplicates, append([]byte{}, k...))
+		}
+	}
+	for _, key := range duplicates {
+		if err := deleteEntry(tx, directory, key); err != nil {
+			return nil, err
+		}
+	}
+	// The run about to be stored is the only one left.
+	usage.Stored = history.Time
+	return nil, writeUsage(tx, keys, directory, usage)
+}
+
+// Usage lists how often each command ran in directory, or in every directory
+// when directory is empty, most recently used first.
+func (s *Store) Usage(directory string) ([]Usage, error) {
+	usages := []Usage{}
+	collect := func(name []byte, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			value, err := s.keys.open(v, commandsBucket, name, k)
+			if err != nil {
+				return fmt.Errorf("could not decode usage in %s: %w", name, err)
+			}
+			var usage Usage
+			if err := json.Unmarshal(value, &usage); err != nil {
+				return fmt.Errorf("could not decode usage of %q in %s: %w", k, name, err)
+			}
+			usage.Directory = string(name)
+			usages = append(usages, usage)
+			return nil
+		})
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if directory != "" {
+			b := nestedBucket(tx, commandsBucket, []byte(directory))
+			if b == nil {
+				return nil
+			}
+			return collect([]byte(directory), b)
+		}
+		commands := tx.Bucket(commandsBucket)
+		if commands == nil {
+			return nil
+		}
+		return commands.ForEach(func(name, value []byte) error {
+			if value != nil {
+				return nil
+			}
+			return collect(name, commands.Bucket(name))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortUsage(usages)
+	return usages, nil
+}
+
+func sortUsage(usages []Usage) {
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].LastSeen.After(usages[j].LastSeen)
+	})
+}
+
+// MergeUsage combines the usage of the same command in different
+// directories, leaving the directory empty.
+func MergeUsage(usages []Usage) []Usage {
+	merged := map[string]*Usage{}
+	order := []string{}
+	for _, usage := range usages {
+		existing, ok := merged[usage.Command]
+		if !ok {
+			first := usage
+			first.Directory = ""
+			merged[usage.Command] = &first
+			order = append(order, usage.Command)
+			continue
+		}
+		existing.Count += usage.Count
+		if usage.FirstSeen.Before(existing.FirstSeen) {
+			existing.FirstSeen = usage.FirstSeen
+		}
+		if usage.LastSeen.After(existing.LastSeen) {
+			existing.LastSeen = usage.LastSeen
+		}
+	}
+	result := make([]Usage, 0, len(order))
+	for _, command := range order {
+		result = append(result, *merged[command])
+	}
+	sortUsage(result)
+	return result
+}
+
+// migrateUsage counts the runs of the entries written before counts existed.
+func migrateUsage(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(commandsBucket); err != nil {
+		return err
+	}
+	return forEachDirectory(tx, func(name []byte, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			// Migrations only see unencrypted databases, encryption came later.
+			history, err := decodeEntry(tx, nil, name, k, v)
+			if err != nil {
+				// Left for fsck.
+				return nil
+			}
+			return countRun(tx, nil, &history)
+		})
+	})
+}